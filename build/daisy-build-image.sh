@@ -78,7 +78,10 @@ echo "AgileOS build status: building unified kernel"
 gsutil cp  "${SOURCES}/linuxx64.efi.stub" .
 
 sectors=$((($blocks * 4096) / 512))
-echo "ip=dhcp console=ttyS0,115200n8 loglevel=4 elevator=noop printk.devkmsg=on dm-mod.create=\"root,,,ro,0 ${sectors} verity ${dmmod}\" root=/dev/dm-0 ro" > cmdline
+# Reserve 2M at 256M for ramoops, which keeps the console, /dev/pmsg0 and
+# panic logs in pstore across a warm reboot.
+ramoops="memmap=2M\$0x10000000 ramoops.mem_address=0x10000000 ramoops.mem_size=0x200000 ramoops.record_size=0x40000 ramoops.console_size=0x80000 ramoops.pmsg_size=0x80000"
+echo "ip=dhcp console=ttyS0,115200n8 loglevel=4 elevator=noop printk.devkmsg=on ${ramoops} dm-mod.create=\"root,,,ro,0 ${sectors} verity ${dmmod}\" root=/dev/dm-0 ro" > cmdline
 objcopy \
   --add-section .osrel="os-release" --change-section-vma .osrel=0x20000 \
   --add-section .cmdline="cmdline" --change-section-vma .cmdline=0x30000 \
@@ -13,10 +13,7 @@ import (
 var messageFuncs = map[string]func() error{
 	"button/power": func() error {
 		logger.Println("ACPI shutdown signal recieved")
-		if err := syscall.Reboot(syscall.LINUX_REBOOT_CMD_POWER_OFF); err != nil {
-			return err
-		}
-		return nil
+		return shutdown(syscall.LINUX_REBOOT_CMD_POWER_OFF)
 	},
 }
 
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// probeSize covers the superblocks of all probed filesystems.
+const probeSize = 0x10000 + 0x1000
+
+type fsInfo struct {
+	Type, UUID, Label string
+}
+
+func formatUUID(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// formatGUID formats a GUID stored in the mixed endian layout used by GPT.
+func formatGUID(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10], b[10:16])
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func readAt(dev string, off int64, n int) ([]byte, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := make([]byte, n)
+	if _, err := f.ReadAt(b, off); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return b, nil
+}
+
+// probeFilesystem identifies the filesystem on dev from its superblock. It
+// returns nil if none is recognized.
+func probeFilesystem(dev string) (*fsInfo, error) {
+	b, err := readAt(dev, 0, probeSize)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case binary.LittleEndian.Uint16(b[0x438:]) == 0xef53:
+		sb := b[0x400:]
+		typ := "ext2"
+		if binary.LittleEndian.Uint32(sb[0x5c:])&0x4 != 0 {
+			typ = "ext3"
+		}
+		// extents or 64bit
+		if binary.LittleEndian.Uint32(sb[0x60:])&(0x40|0x80) != 0 {
+			typ = "ext4"
+		}
+		return &fsInfo{Type: typ, UUID: formatUUID(sb[0x68:0x78]), Label: cString(sb[0x78:0x88])}, nil
+	case string(b[0:4]) == "XFSB":
+		return &fsInfo{Type: "xfs", UUID: formatUUID(b[32:48]), Label: cString(b[108:120])}, nil
+	case string(b[0x10040:0x10048]) == "_BHRfS_M":
+		return &fsInfo{Type: "btrfs", UUID: formatUUID(b[0x10020:0x10030]), Label: cString(b[0x1012b:0x1022b])}, nil
+	case string(b[0xff6:0x1000]) == "SWAPSPACE2":
+		return &fsInfo{Type: "swap", UUID: formatUUID(b[0x40c:0x41c]), Label: cString(b[0x41c:0x42c])}, nil
+	case b[0x1fe] == 0x55 && b[0x1ff] == 0xaa && string(b[0x52:0x57]) == "FAT32":
+		return &fsInfo{Type: "vfat", UUID: fatSerial(b[0x43:0x47]), Label: fatLabel(b[0x47:0x52])}, nil
+	case b[0x1fe] == 0x55 && b[0x1ff] == 0xaa && string(b[0x36:0x39]) == "FAT":
+		return &fsInfo{Type: "vfat", UUID: fatSerial(b[0x27:0x2b]), Label: fatLabel(b[0x2b:0x36])}, nil
+	}
+	return nil, nil
+}
+
+func fatSerial(b []byte) string {
+	s := binary.LittleEndian.Uint32(b)
+	return fmt.Sprintf("%04X-%04X", s>>16, s&0xffff)
+}
+
+func fatLabel(b []byte) string {
+	l := cString(b)
+	if l == "NO NAME" {
+		return ""
+	}
+	return l
+}
+
+// partUUID returns the partition UUID of partition partn on disk, for GPT
+// the unique partition GUID, for MBR the disk signature and number.
+func partUUID(disk string, partn int, sectorSize int64) (string, error) {
+	hdr, err := readAt(disk, sectorSize, 92)
+	if err != nil {
+		return "", err
+	}
+	if string(hdr[0:8]) != "EFI PART" {
+		mbr, err := readAt(disk, 0, 512)
+		if err != nil {
+			return "", err
+		}
+		if mbr[510] != 0x55 || mbr[511] != 0xaa {
+			return "", errors.New("no partition table")
+		}
+		return fmt.Sprintf("%08x-%02x", binary.LittleEndian.Uint32(mbr[0x1b8:]), partn), nil
+	}
+
+	entriesLBA := int64(binary.LittleEndian.Uint64(hdr[72:]))
+	count := int(binary.LittleEndian.Uint32(hdr[80:]))
+	size := int64(binary.LittleEndian.Uint32(hdr[84:]))
+	if partn < 1 || partn > count || size < 32 {
+		return "", fmt.Errorf("partition %d not in GPT", partn)
+	}
+	entry, err := readAt(disk, entriesLBA*sectorSize+int64(partn-1)*size, 32)
+	if err != nil {
+		return "", err
+	}
+	return formatGUID(entry[16:32]), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// calendarSpec is a cron style schedule: minute hour day-of-month month
+// day-of-week. Each field accepts *, numbers, ranges (a-b), lists (a,b) and
+// steps (*/n or a-b/n). Unlike cron, day-of-month and day-of-week must both
+// match.
+type calendarSpec struct {
+	minute, hour, dom, month, dow uint64
+}
+
+var calendarFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 6},
+}
+
+func parseCalendar(s string) (*calendarSpec, error) {
+	fields := strings.Fields(s)
+	if len(fields) != len(calendarFields) {
+		return nil, fmt.Errorf("expected %d fields, got %d", len(calendarFields), len(fields))
+	}
+
+	var bits [5]uint64
+	for i, f := range fields {
+		b, err := parseCalendarField(f, calendarFields[i].min, calendarFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", calendarFields[i].name, err)
+		}
+		bits[i] = b
+	}
+	c := &calendarSpec{minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4]}
+	if !c.possible() {
+		return nil, fmt.Errorf("%q never matches", s)
+	}
+	return c, nil
+}
+
+// daysIn is the most days each month can have.
+var daysIn = [13]int{0, 31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
+
+// possible reports whether some month of the spec has one of its days.
+// Every date falls on each day of the week within 28 years, so the day of
+// the week does not matter.
+func (c *calendarSpec) possible() bool {
+	for m := 1; m <= 12; m++ {
+		if c.month&(1<<uint(m)) != 0 && c.dom&(1<<uint(daysIn[m]+1)-1) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCalendarField(f string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			r := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(r[0]); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if len(r) == 2 {
+				if hi, err = strconv.Atoi(r[1]); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first minute strictly after t that matches the spec,
+// ok is false if none does within calendarHorizon.
+func (c *calendarSpec) next(t time.Time) (next time.Time, ok bool) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(calendarHorizon, 0, 0); t.Before(end); t = t.Add(time.Minute) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if c.dom&(1<<uint(t.Day())) == 0 || c.dow&(1<<uint(t.Weekday())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			// Not t.Truncate, hours are not aligned in all time zones.
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) != 0 {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// calendarHorizon is how many years next looks ahead. February 29 takes
+// up to 28 years to fall on a given day of the week.
+const calendarHorizon = 30
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCalendar(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want calendarSpec
+		err  string
+	}{
+		{
+			spec: "* * * * *",
+			want: calendarSpec{minute: 1<<60 - 1, hour: 1<<24 - 1, dom: 1<<32 - 2, month: 1<<13 - 2, dow: 1<<7 - 1},
+		},
+		{
+			spec: "0,30 */6 1-7 2-12/5 1-5",
+			want: calendarSpec{minute: 1 | 1<<30, hour: 1 | 1<<6 | 1<<12 | 1<<18, dom: 0xfe, month: 1<<2 | 1<<7 | 1<<12, dow: 0x3e},
+		},
+		{spec: "0 0 29 2 *", want: calendarSpec{minute: 1, hour: 1, dom: 1 << 29, month: 1 << 2, dow: 1<<7 - 1}},
+		{spec: "* * * *", err: "expected 5 fields, got 4"},
+		{spec: "60 * * * *", err: "minute: \"60\" out of range 0-59"},
+		{spec: "* * 0 * *", err: "day of month: \"0\" out of range 1-31"},
+		{spec: "* 5-3 * * *", err: "hour: \"5-3\" out of range 0-23"},
+		{spec: "*/0 * * * *", err: "minute: bad step"},
+		{spec: "a * * * *", err: "minute: bad value"},
+		{spec: "* * 30 2 *", err: "never matches"},
+		{spec: "* * 31 4,6,9,11 *", err: "never matches"},
+	} {
+		c, err := parseCalendar(tc.spec)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("parseCalendar(%q) error = %v, want one containing %q", tc.spec, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCalendar(%q): %v", tc.spec, err)
+			continue
+		}
+		if *c != tc.want {
+			t.Errorf("parseCalendar(%q) = %+v, want %+v", tc.spec, *c, tc.want)
+		}
+	}
+}
+
+func TestCalendarNext(t *testing.T) {
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skip(err)
+	}
+	date := func(s string) time.Time {
+		d, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	for _, tc := range []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", date("2024-01-01 10:00"), date("2024-01-01 10:01")},
+		{"30 * * * *", date("2024-01-01 10:30"), date("2024-01-01 11:30")},
+		{"0 3 * * *", date("2024-01-01 10:00"), date("2024-01-02 03:00")},
+		{"0 0 1 * *", date("2024-12-15 00:00"), date("2025-01-01 00:00")},
+		// Both the day of the month and of the week must match.
+		{"0 0 13 * 5", date("2024-01-01 00:00"), date("2024-09-13 00:00")},
+		{"0 0 29 2 *", date("2025-01-01 00:00"), date("2028-02-29 00:00")},
+		// February 29 on a Monday.
+		{"0 0 29 2 1", date("2024-03-01 00:00"), date("2044-02-29 00:00")},
+		// Hours start on the half hour in UTC.
+		{"0 11 * * *", time.Date(2024, 1, 1, 10, 17, 0, 0, kolkata), time.Date(2024, 1, 1, 11, 0, 0, 0, kolkata)},
+	} {
+		c, err := parseCalendar(tc.spec)
+		if err != nil {
+			t.Fatalf("parseCalendar(%q): %v", tc.spec, err)
+		}
+		got, ok := c.next(tc.from)
+		if !ok || !got.Equal(tc.want) {
+			t.Errorf("%q.next(%s) = %s, %v, want %s", tc.spec, tc.from, got, ok, tc.want)
+		}
+	}
+}
+
+func TestCalendarNextNone(t *testing.T) {
+	// parseCalendar rejects these, next must not hand out a time anyway.
+	c := &calendarSpec{minute: 1, hour: 1, dom: 1 << 30, month: 1 << 2, dow: 1<<7 - 1}
+	if got, ok := c.next(time.Now()); ok || !got.IsZero() {
+		t.Errorf("next = %s, %v, want no match", got, ok)
+	}
+}
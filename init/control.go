@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// controlSocket serves a small HTTP/JSON API, access is limited to root by
+// the socket's permissions.
+var controlSocket = "/run/ecl/init.sock"
+
+type serviceStatus struct {
+	File    string
+	Name    string
+	Type    string
+	PID     int `json:",omitempty"`
+	History []runRecord
+}
+
+func (sup *supervisor) status() []serviceStatus {
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+
+	var st []serviceStatus
+	for file, svc := range sup.services {
+		svc.mu.Lock()
+		s := serviceStatus{
+			File:    file,
+			Name:    svc.name,
+			Type:    svc.typ,
+			History: append([]runRecord(nil), svc.history...),
+		}
+		if svc.cmd != nil && svc.cmd.Process != nil {
+			s.PID = svc.cmd.Process.Pid
+		}
+		svc.mu.Unlock()
+		st = append(st, s)
+	}
+	sort.Slice(st, func(i, j int) bool { return st[i].File < st[j].File })
+	return st
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func controlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/services", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, services.status())
+	})
+	mux.HandleFunc("/v1/boot", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, boot.status())
+	})
+	mux.HandleFunc("/v1/time", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, timesync.get())
+	})
+	mux.HandleFunc("/v1/events", serveEvents)
+	mux.HandleFunc("/v1/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		services.reload()
+		writeJSON(w, services.status())
+	})
+	return mux
+}
+
+func runControl() error {
+	if err := os.MkdirAll(filepath.Dir(controlSocket), 0755); err != nil {
+		return err
+	}
+	os.Remove(controlSocket)
+	l, err := net.Listen("unix", controlSocket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(controlSocket, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	return http.Serve(l, controlHandler())
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	coredumpDir = "/var/lib/ecl/coredumps"
+	// coredumpConfDirs hold *.conf files of KEY=VALUE lines setting the
+	// quotas: MAX_SIZE of a single core before compression, MAX_TOTAL of
+	// the compressed cores kept and MAX_COUNT of cores kept.
+	coredumpConfDirs = []string{"/etc/coredump.d", "/var/lib/ecl/coredump.d"}
+)
+
+type coredumpQuota struct {
+	maxSize, maxTotal uint64
+	maxCount          int
+}
+
+// coredumpInfo is stored next to each core, caaos reads it to map cores to
+// its containers.
+type coredumpInfo struct {
+	Time       time.Time
+	PID        int
+	TID        int
+	Signal     int
+	UID, GID   int
+	Executable string
+	Comm       string
+	Cmdline    []string `json:",omitempty"`
+	Cgroup     string
+	// Namespace and Container are set for processes of containerd
+	// containers, which run in the cgroup /<namespace>/<id>.
+	Namespace string `json:",omitempty"`
+	Container string `json:",omitempty"`
+	// Core is the file name of the compressed core, empty if it was
+	// dropped to stay within the quota.
+	Core      string `json:",omitempty"`
+	Size      int64
+	Truncated bool `json:",omitempty"`
+}
+
+func loadCoredumpQuota() (coredumpQuota, error) {
+	// A bad config falls back to the defaults as a whole.
+	defaults := coredumpQuota{maxSize: 1 << 30, maxTotal: 4 << 30, maxCount: 16}
+	q := defaults
+	for _, file := range confFiles(coredumpConfDirs, ".conf") {
+		lines, err := readConfLines(file)
+		if err != nil {
+			return defaults, err
+		}
+		for _, line := range lines {
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				return defaults, fmt.Errorf("%s: bad line %q", file, line)
+			}
+			key, value := strings.TrimSpace(kv[0]), strings.Trim(strings.TrimSpace(kv[1]), `"`)
+			switch key {
+			case "MAX_SIZE":
+				q.maxSize, err = parseCoreSize(value)
+			case "MAX_TOTAL":
+				q.maxTotal, err = parseCoreSize(value)
+			case "MAX_COUNT":
+				q.maxCount, err = strconv.Atoi(value)
+			default:
+				err = fmt.Errorf("unknown key %s", key)
+			}
+			if err != nil {
+				return defaults, fmt.Errorf("%s: %v", file, err)
+			}
+		}
+	}
+	return q, nil
+}
+
+// parseCoreSize is parseMemorySize without percentages, which the quotas
+// have nothing to be relative to.
+func parseCoreSize(value string) (uint64, error) {
+	if strings.HasSuffix(value, "%") {
+		return 0, fmt.Errorf("size %q cannot be a percentage", value)
+	}
+	return parseMemorySize(value, 0)
+}
+
+// processCgroup returns the cgroup v2 path of pid.
+func processCgroup(pid int) string {
+	lines, _ := readConfLines(fmt.Sprintf("/proc/%d/cgroup", pid))
+	for _, line := range lines {
+		if strings.HasPrefix(line, "0::") {
+			return line[3:]
+		}
+	}
+	return ""
+}
+
+// containerFromCgroup splits a containerd cgroup path /<namespace>/<id>,
+// the layout containerd uses for the containers of any namespace. Services
+// of init stay in the root cgroup.
+func containerFromCgroup(cgroup string) (namespace, id string) {
+	parts := strings.Split(strings.Trim(cgroup, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+type coreFile struct {
+	base string
+	time time.Time
+	size int64
+}
+
+// listCores returns the stored cores, oldest first.
+func listCores() []coreFile {
+	infos, _ := filepath.Glob(filepath.Join(coredumpDir, "*.json"))
+	var cores []coreFile
+	for _, info := range infos {
+		fi, err := os.Stat(info)
+		if err != nil {
+			continue
+		}
+		base := strings.TrimSuffix(info, ".json")
+		c := coreFile{base: base, time: fi.ModTime()}
+		if fi, err := os.Stat(base + ".gz"); err == nil {
+			c.size = fi.Size()
+		}
+		cores = append(cores, c)
+	}
+	sort.Slice(cores, func(i, j int) bool { return cores[i].time.Before(cores[j].time) })
+	return cores
+}
+
+func removeCore(base string) {
+	os.Remove(base + ".gz")
+	os.Remove(base + ".json")
+}
+
+// pruneCores removes the oldest cores other than keep until room more fit
+// in the count quota and the ones kept fit in maxTotal.
+func pruneCores(q coredumpQuota, keep string, room int) {
+	cores := listCores()
+	var total uint64
+	for _, c := range cores {
+		total += uint64(c.size)
+	}
+	count := len(cores)
+	for _, c := range cores {
+		if count+room <= q.maxCount && total <= q.maxTotal {
+			break
+		}
+		if c.base == keep {
+			continue
+		}
+		removeCore(c.base)
+		count--
+		total -= uint64(c.size)
+	}
+}
+
+// writeCore compresses at most limit bytes of r to path.
+func writeCore(path string, r io.Reader, limit uint64) (int64, bool, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	n, err := io.CopyN(zw, r, int64(limit))
+	truncated := false
+	if err == nil {
+		// A byte past the limit means the core was cut short.
+		var b [1]byte
+		m, _ := r.Read(b[:])
+		truncated = m > 0
+	} else if err != io.EOF {
+		return n, false, err
+	}
+	if err := zw.Close(); err != nil {
+		return n, truncated, err
+	}
+	return n, truncated, f.Close()
+}
+
+func kmsg(format string, v ...interface{}) {
+	f, err := os.OpenFile("/dev/kmsg", os.O_WRONLY, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, format+"\n", v...)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "<4>coredump: "+format+"\n", v...)
+}
+
+// coredumpHelper is run by the kernel through kernel.core_pattern with
+// "%P %I %s %t %u %g" as arguments and the core on stdin.
+func coredumpHelper(args []string) int {
+	if len(args) != 6 {
+		kmsg("want 6 arguments, got %q", args)
+		return 1
+	}
+	var n [6]int
+	for i, a := range args {
+		v, err := strconv.Atoi(a)
+		if err != nil {
+			kmsg("bad argument %q", a)
+			return 1
+		}
+		n[i] = v
+	}
+	info := coredumpInfo{
+		PID:    n[0],
+		TID:    n[1],
+		Signal: n[2],
+		Time:   time.Unix(int64(n[3]), 0),
+		UID:    n[4],
+		GID:    n[5],
+	}
+	proc := fmt.Sprintf("/proc/%d", info.PID)
+	info.Executable, _ = os.Readlink(proc + "/exe")
+	info.Comm = readSysFile(proc + "/comm")
+	if b, err := ioutil.ReadFile(proc + "/cmdline"); err == nil {
+		info.Cmdline = strings.Split(strings.TrimRight(string(b), "\x00"), "\x00")
+	}
+	info.Cgroup = processCgroup(info.PID)
+	info.Namespace, info.Container = containerFromCgroup(info.Cgroup)
+
+	q, err := loadCoredumpQuota()
+	if err != nil {
+		kmsg("%v", err)
+	}
+	if err := os.MkdirAll(coredumpDir, 0700); err != nil {
+		kmsg("%v", err)
+		return 1
+	}
+	pruneCores(q, "", 1)
+
+	base := filepath.Join(coredumpDir, fmt.Sprintf("core.%s.%d.%d", strings.Replace(info.Comm, "/", "_", -1), info.PID, n[3]))
+	info.Core = filepath.Base(base) + ".gz"
+	info.Size, info.Truncated, err = writeCore(base+".gz", os.Stdin, q.maxSize)
+	if err != nil {
+		kmsg("writing %s.gz: %v", base, err)
+		os.Remove(base + ".gz")
+		info.Core = ""
+	}
+	if fi, err := os.Stat(base + ".gz"); err == nil && uint64(fi.Size()) > q.maxTotal {
+		os.Remove(base + ".gz")
+		info.Core = ""
+	}
+
+	b, _ := json.MarshalIndent(info, "", "  ")
+	if err := ioutil.WriteFile(base+".json", b, 0600); err != nil {
+		kmsg("writing %s.json: %v", base, err)
+		return 1
+	}
+	pruneCores(q, base, 0)
+
+	where := info.Core
+	if where == "" {
+		where = "core dropped by quota"
+	}
+	if info.Container != "" {
+		kmsg("%s[%d] of container %s dumped core on signal %d: %s", info.Comm, info.PID, info.Container, info.Signal, where)
+	} else {
+		kmsg("%s[%d] dumped core on signal %d: %s", info.Comm, info.PID, info.Signal, where)
+	}
+	return 0
+}
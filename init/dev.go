@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// devEnv passes the development mode config to init re-executed in the new
+// namespaces.
+const devEnv = "ECL_DEV_CONFIG"
+
+type devConfig struct {
+	Root     string
+	Services string
+}
+
+// devMode runs init on a developer's machine to try out service files: init
+// is re-executed as PID 1 of new user, mount and PID namespaces, with state
+// kept under a root directory. Only the supervisor and the control interface
+// run, none of the boot steps that touch hardware or the real mount table.
+func devMode(args []string) int {
+	fs := flag.NewFlagSet("dev", flag.ContinueOnError)
+	root := fs.String("root", filepath.Join(os.TempDir(), "ecl-dev"), "directory for the control socket and state")
+	svcs := fs.String("services", "", "service file directory (default <root>/etc/init)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	c := devConfig{Services: *svcs}
+	var err error
+	if c.Root, err = filepath.Abs(*root); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if c.Services == "" {
+		c.Services = filepath.Join(c.Root, "etc/init")
+	}
+	if c.Services, err = filepath.Abs(c.Services); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, dir := range []string{c.Services, filepath.Join(c.Root, "run/ecl")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	b, _ := json.Marshal(c)
+
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Args = []string{"init"}
+	cmd.Env = append(os.Environ(), devEnv+"="+string(b))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		Pdeathsig:   syscall.SIGKILL,
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, "starting init in new namespaces:", err)
+		return 1
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range sigs {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// runDev is init as PID 1 of the development namespaces.
+func runDev() {
+	var c devConfig
+	if err := json.Unmarshal([]byte(os.Getenv(devEnv)), &c); err != nil {
+		fmt.Fprintln(os.Stderr, "bad development config:", err)
+		os.Exit(1)
+	}
+	os.Unsetenv(devEnv)
+
+	// Keep mounts, including those of services, from reaching the host.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		fmt.Fprintln(os.Stderr, "making / private:", err)
+		os.Exit(1)
+	}
+	mount("proc", "/proc", "proc", nodev|nosuid|noexec|relatime, "")
+	go logs.Run()
+
+	svcDirs = []string{c.Services}
+	controlSocket = filepath.Join(c.Root, "run/ecl/init.sock")
+	logger.Printf("Development mode, services from %s, control socket %s", c.Services, controlSocket)
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-term
+		logger.Println("Stopping services")
+		services.apply(nil)
+		logs.Flush(5 * time.Second)
+		os.Exit(0)
+	}()
+
+	runServices()
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// deviceRulesDirs hold *.rules files with lines of the form
+	// "<devname glob> <mode> [user] [group]", e.g. "kvm 0660 root kvm".
+	// The last matching rule wins.
+	deviceRulesDirs = []string{"/etc/devices.d", "/var/lib/ecl/devices.d"}
+	devRoot         = "/dev"
+	sysRoot         = "/sys"
+)
+
+// settleTimeout bounds how long boot waits for the coldplug events.
+const settleTimeout = 5 * time.Second
+
+type deviceRule struct {
+	pattern  string
+	mode     os.FileMode
+	uid, gid int
+}
+
+// deviceManager handles kernel uevents: it applies device permissions,
+// maintains the /dev/disk symlinks and publishes device events.
+type deviceManager struct {
+	rules []deviceRule
+
+	mu     sync.Mutex
+	links  map[string][]string // DEVPATH -> symlinks
+	seqnum uint64
+	cond   *sync.Cond
+}
+
+func loadDeviceRules() []deviceRule {
+	var rules []deviceRule
+	for _, file := range confFiles(deviceRulesDirs, ".rules") {
+		lines, err := readConfLines(file)
+		if err != nil {
+			boot.fail("devices", err)
+			continue
+		}
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || len(fields) > 4 {
+				boot.fail("devices", fmt.Errorf("%s: bad rule %q", file, line))
+				continue
+			}
+			mode, err := strconv.ParseUint(fields[1], 8, 32)
+			if err != nil {
+				boot.fail("devices", fmt.Errorf("%s: bad mode in %q", file, line))
+				continue
+			}
+			r := deviceRule{pattern: fields[0], mode: os.FileMode(mode), uid: -1, gid: -1}
+			if len(fields) > 2 {
+				if r.uid, _, err = lookupUser(fields[2]); err != nil {
+					boot.fail("devices", fmt.Errorf("%s: %v", file, err))
+					continue
+				}
+			}
+			if len(fields) > 3 {
+				if r.gid, err = lookupGroup(fields[3]); err != nil {
+					boot.fail("devices", fmt.Errorf("%s: %v", file, err))
+					continue
+				}
+			}
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+func parseUevent(b []byte) map[string]string {
+	parts := bytes.Split(b, []byte{0})
+	// Messages rebroadcast by udev start with "libudev", only the kernel's
+	// are of interest.
+	if len(parts) == 0 || !bytes.Contains(parts[0], []byte("@")) {
+		return nil
+	}
+	env := map[string]string{}
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(string(p), "=", 2)
+		if len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+	return env
+}
+
+func readSysFile(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// escapeLink escapes characters not safe in a link name the way udev does.
+func escapeLink(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', strings.IndexByte("#+-.:=@_", c) >= 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+	return b.String()
+}
+
+func idPart(s string) string {
+	return strings.Replace(strings.TrimSpace(s), " ", "_", -1)
+}
+
+// diskSerial returns the serial number of the disk at sysDisk and the bus it
+// was read from.
+func diskSerial(sysDisk string) (serial, bus string) {
+	dev := filepath.Join(sysDisk, "device")
+
+	// SCSI, the unit serial number VPD page holds the serial after a 4 byte
+	// header.
+	if pg80, err := ioutil.ReadFile(filepath.Join(dev, "vpd_pg80")); err == nil && len(pg80) > 4 {
+		if serial := idPart(cString(pg80[4:])); serial != "" {
+			return serial, "scsi"
+		}
+	}
+	// NVMe, serial and model are attributes of the controller.
+	if serial := idPart(readSysFile(filepath.Join(dev, "serial"))); serial != "" {
+		return serial, "nvme"
+	}
+	if serial := idPart(readSysFile(filepath.Join(sysDisk, "serial"))); serial != "" {
+		return serial, "virtio"
+	}
+	return "", ""
+}
+
+// diskIDs returns the by-id names of the disk at sysDisk.
+func diskIDs(sysDisk string) []string {
+	dev := filepath.Join(sysDisk, "device")
+	serial, bus := diskSerial(sysDisk)
+	vendor := idPart(readSysFile(filepath.Join(dev, "vendor")))
+	model := idPart(readSysFile(filepath.Join(dev, "model")))
+
+	switch bus {
+	case "scsi":
+		ids := []string{fmt.Sprintf("scsi-0%s_%s_%s", vendor, model, serial)}
+		if vendor == "Google" {
+			ids = append(ids, "google-"+serial)
+		}
+		return ids
+	case "nvme":
+		return []string{fmt.Sprintf("nvme-%s_%s", model, serial)}
+	case "virtio":
+		return []string{"virtio-" + serial}
+	}
+	return nil
+}
+
+// blockLinks returns the /dev/disk symlinks, relative to devRoot, for the
+// block device described by env.
+func blockLinks(env map[string]string) []string {
+	name := env["DEVNAME"]
+	dev := filepath.Join(devRoot, name)
+	sysDev := filepath.Join(sysRoot, env["DEVPATH"])
+	if readSysFile(filepath.Join(sysDev, "size")) == "0" {
+		return nil
+	}
+
+	sysDisk, disk := sysDev, name
+	partn := env["PARTN"]
+	if env["DEVTYPE"] == "partition" {
+		sysDisk = filepath.Dir(sysDev)
+		disk = filepath.Base(sysDisk)
+	}
+
+	var links []string
+	if dm := dmName(sysDev); dm != "" {
+		links = append(links, "mapper/"+escapeLink(dm))
+	}
+	for _, id := range diskIDs(sysDisk) {
+		if partn != "" {
+			id += "-part" + partn
+		}
+		links = append(links, "disk/by-id/"+escapeLink(id))
+	}
+
+	if fs, err := probeFilesystem(dev); err == nil && fs != nil {
+		if fs.UUID != "" {
+			links = append(links, "disk/by-uuid/"+escapeLink(fs.UUID))
+		}
+		if fs.Label != "" {
+			links = append(links, "disk/by-label/"+escapeLink(fs.Label))
+		}
+	}
+
+	if n, err := strconv.Atoi(partn); err == nil {
+		sectorSize, err := strconv.ParseInt(readSysFile(filepath.Join(sysDisk, "queue/logical_block_size")), 10, 64)
+		if err != nil || sectorSize == 0 {
+			sectorSize = 512
+		}
+		if u, err := partUUID(filepath.Join(devRoot, disk), n, sectorSize); err == nil {
+			links = append(links, "disk/by-partuuid/"+u)
+		}
+	}
+	return links
+}
+
+// makeLink points devRoot/link at devRoot/name, replacing any existing link.
+func makeLink(name, link string) error {
+	path := filepath.Join(devRoot, link)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	target, err := filepath.Rel(filepath.Dir(path), filepath.Join(devRoot, name))
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// removeLink removes devRoot/link if it still points at devRoot/name.
+func removeLink(name, link string) {
+	path := filepath.Join(devRoot, link)
+	target, err := os.Readlink(path)
+	if err != nil || filepath.Base(target) != filepath.Base(name) {
+		return
+	}
+	os.Remove(path)
+}
+
+func (m *deviceManager) updateLinks(env map[string]string) {
+	name, devpath := env["DEVNAME"], env["DEVPATH"]
+	var links []string
+	if env["ACTION"] != "remove" {
+		links = blockLinks(env)
+	}
+
+	m.mu.Lock()
+	old := m.links[devpath]
+	if len(links) > 0 {
+		m.links[devpath] = links
+	} else {
+		delete(m.links, devpath)
+	}
+	m.mu.Unlock()
+
+	keep := map[string]bool{}
+	for _, l := range links {
+		keep[l] = true
+		if err := makeLink(name, l); err != nil {
+			logger.Printf("Error creating %s: %v", l, err)
+		}
+	}
+	for _, l := range old {
+		if !keep[l] {
+			removeLink(name, l)
+		}
+	}
+}
+
+func (m *deviceManager) applyRules(name string) {
+	path := filepath.Join(devRoot, name)
+	for i := len(m.rules) - 1; i >= 0; i-- {
+		r := m.rules[i]
+		if ok, _ := filepath.Match(r.pattern, name); !ok {
+			continue
+		}
+		if err := os.Chmod(path, r.mode); err != nil {
+			logger.Printf("Error setting mode of %s: %v", path, err)
+		}
+		if r.uid >= 0 || r.gid >= 0 {
+			if err := os.Lchown(path, r.uid, r.gid); err != nil {
+				logger.Printf("Error setting owner of %s: %v", path, err)
+			}
+		}
+		return
+	}
+}
+
+func (m *deviceManager) handle(env map[string]string) {
+	action := env["ACTION"]
+	if name := env["DEVNAME"]; name != "" {
+		if action == "add" || action == "change" {
+			m.applyRules(name)
+		}
+		if env["SUBSYSTEM"] == "block" {
+			m.updateLinks(env)
+		}
+	}
+	events.publish("device/"+action, env)
+
+	if seq, err := strconv.ParseUint(env["SEQNUM"], 10, 64); err == nil {
+		m.mu.Lock()
+		if seq > m.seqnum {
+			m.seqnum = seq
+		}
+		m.cond.Broadcast()
+		m.mu.Unlock()
+	}
+}
+
+func (m *deviceManager) listen(fd int) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == unix.EINTR || err == unix.ENOBUFS {
+				continue
+			}
+			boot.fail("devices", fmt.Errorf("reading uevents: %v", err))
+			return
+		}
+		if env := parseUevent(buf[:n]); env != nil {
+			m.handle(env)
+		}
+	}
+}
+
+// coldplug asks the kernel to replay add events for existing devices.
+func coldplug() {
+	files, _ := filepath.Glob(filepath.Join(sysRoot, "class/*/*/uevent"))
+	seen := map[string]bool{}
+	for _, f := range files {
+		real, err := filepath.EvalSymlinks(f)
+		if err != nil || seen[real] {
+			continue
+		}
+		seen[real] = true
+		if err := ioutil.WriteFile(real, []byte("add"), 0200); err != nil {
+			logger.Printf("Error triggering %s: %v", real, err)
+		}
+	}
+}
+
+// settle waits until all events up to the current kernel sequence number have
+// been handled.
+func (m *deviceManager) settle(timeout time.Duration) {
+	want, err := strconv.ParseUint(readSysFile(filepath.Join(sysRoot, "kernel/uevent_seqnum")), 10, 64)
+	if err != nil {
+		return
+	}
+	timer := time.AfterFunc(timeout, func() {
+		m.mu.Lock()
+		m.cond.Broadcast()
+		m.mu.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.seqnum < want && time.Now().Before(deadline) {
+		m.cond.Wait()
+	}
+}
+
+// runDevices starts the uevent listener, replays existing devices and waits
+// for them to be handled.
+func runDevices() error {
+	m := &deviceManager{rules: loadDeviceRules(), links: map[string][]string{}}
+	m.cond = sync.NewCond(&m.mu)
+
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return err
+	}
+	unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, 8<<20)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	go m.listen(fd)
+
+	coldplug()
+	m.settle(settleTimeout)
+	return nil
+}
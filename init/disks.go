@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// disksDirs hold *.json files with a list of disk configs, configs for
+	// the same mount point in later files and in the ecl-disks metadata
+	// attribute override earlier ones.
+	disksDirs      = []string{"/etc/disks.d", "/var/lib/ecl/disks.d"}
+	disksAttribute = "instance/attributes/ecl-disks"
+)
+
+// defaultChunkKB is the stripe chunk size used if none is configured.
+const defaultChunkKB = 256
+
+// mke2fs is shipped by the e2fsprogs package, the image has no other mkfs
+// so only the ext filesystems can be formatted.
+var mke2fs = "/bin/mke2fs"
+
+var formattable = map[string]bool{"ext2": true, "ext3": true, "ext4": true}
+
+var errDiskMissing = errors.New("disk not attached")
+
+// diskConfig describes a data disk. Devices name disks by kernel name
+// ("sdb"), /dev/disk/by-id name ("google-data"), serial or path, more than
+// one device are striped together (RAID0).
+type diskConfig struct {
+	Name       string `json:",omitempty"`
+	Devices    []string
+	FSType     string `json:",omitempty"`
+	Format     bool   `json:",omitempty"`
+	MountPoint string
+	Options    string `json:",omitempty"`
+	ChunkKB    int    `json:",omitempty"`
+}
+
+func (d *diskConfig) validate() error {
+	if !filepath.IsAbs(d.MountPoint) {
+		return fmt.Errorf("mount point %q is not absolute", d.MountPoint)
+	}
+	if len(d.Devices) == 0 {
+		return fmt.Errorf("%s: no devices", d.MountPoint)
+	}
+	if d.Format && d.FSType == "" {
+		return fmt.Errorf("%s: Format requires FSType", d.MountPoint)
+	}
+	if d.Format && !formattable[d.FSType] {
+		return fmt.Errorf("%s: cannot format %s, only ext2, ext3 and ext4", d.MountPoint, d.FSType)
+	}
+	if d.Name == "" {
+		d.Name = filepath.Base(d.MountPoint)
+	}
+	if d.ChunkKB == 0 {
+		d.ChunkKB = defaultChunkKB
+	}
+	if d.ChunkKB < 4 || d.ChunkKB&(d.ChunkKB-1) != 0 {
+		return fmt.Errorf("%s: ChunkKB must be a power of two of at least 4", d.MountPoint)
+	}
+	return nil
+}
+
+func parseDiskConfigs(b []byte, configs map[string]*diskConfig, order *[]string) error {
+	var list []*diskConfig
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	for _, d := range list {
+		d.MountPoint = filepath.Clean(d.MountPoint)
+		if err := d.validate(); err != nil {
+			return err
+		}
+		if _, ok := configs[d.MountPoint]; !ok {
+			*order = append(*order, d.MountPoint)
+		}
+		configs[d.MountPoint] = d
+	}
+	return nil
+}
+
+// loadDiskConfigs reads the disk configs from disksDirs.
+func loadDiskConfigs() []*diskConfig {
+	configs := map[string]*diskConfig{}
+	var order []string
+	for _, file := range confFiles(disksDirs, ".json") {
+		b, err := ioutil.ReadFile(file)
+		if err == nil {
+			err = parseDiskConfigs(b, configs, &order)
+		}
+		if err != nil {
+			boot.fail("disks", fmt.Errorf("%s: %v", file, err))
+		}
+	}
+	var list []*diskConfig
+	for _, mp := range order {
+		list = append(list, configs[mp])
+	}
+	return list
+}
+
+// metadataDiskConfigs reads the disk configs from the ecl-disks metadata
+// attribute, which may take until the metadata client times out.
+func metadataDiskConfigs() []*diskConfig {
+	attr, err := getMetadata(disksAttribute)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Printf("Error reading disk config from metadata: %v", err)
+		}
+		return nil
+	}
+	configs := map[string]*diskConfig{}
+	var order []string
+	if err := parseDiskConfigs([]byte(attr), configs, &order); err != nil {
+		boot.fail("disks", fmt.Errorf("metadata ecl-disks: %v", err))
+		return nil
+	}
+	var list []*diskConfig
+	for _, mp := range order {
+		list = append(list, configs[mp])
+	}
+	return list
+}
+
+// resolveDisk finds the device node of the disk named by sel.
+func resolveDisk(sel string) (string, error) {
+	if filepath.IsAbs(sel) {
+		if _, err := os.Stat(sel); err != nil {
+			return "", errDiskMissing
+		}
+		return sel, nil
+	}
+	if _, err := os.Stat(filepath.Join(devRoot, "disk/by-id", sel)); err == nil {
+		return filepath.Join(devRoot, "disk/by-id", sel), nil
+	}
+	if _, err := os.Stat(filepath.Join(sysRoot, "class/block", sel)); err == nil {
+		return filepath.Join(devRoot, sel), nil
+	}
+	disks, _ := filepath.Glob(filepath.Join(sysRoot, "block/*"))
+	for _, sysDisk := range disks {
+		if serial, _ := diskSerial(sysDisk); serial != "" && serial == idPart(sel) {
+			return filepath.Join(devRoot, filepath.Base(sysDisk)), nil
+		}
+	}
+	return "", errDiskMissing
+}
+
+// hasPartitions reports whether the disk at dev has partitions.
+func hasPartitions(dev string) bool {
+	real, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return false
+	}
+	parts, _ := filepath.Glob(filepath.Join(sysRoot, "class/block", filepath.Base(real), "*/partition"))
+	return len(parts) > 0
+}
+
+// mkfs creates a filesystem of type fstype, one of formattable, on dev.
+func mkfs(fstype, dev string) error {
+	// Skip zeroing the inode tables and journal, the kernel does it lazily
+	// after mounting.
+	cmd := exec.Command(mke2fs, "-t", fstype, "-F", "-E", "lazy_itable_init=1,lazy_journal_init=1", dev)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mke2fs -t %s %s: %v: %s", fstype, dev, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+var mountOptions = map[string]uintptr{
+	"defaults":   0,
+	"rw":         0,
+	"ro":         unix.MS_RDONLY,
+	"nodev":      unix.MS_NODEV,
+	"noexec":     unix.MS_NOEXEC,
+	"nosuid":     unix.MS_NOSUID,
+	"noatime":    unix.MS_NOATIME,
+	"nodiratime": unix.MS_NODIRATIME,
+	"relatime":   unix.MS_RELATIME,
+	"sync":       unix.MS_SYNCHRONOUS,
+	"dirsync":    unix.MS_DIRSYNC,
+}
+
+// parseMountOptions splits comma separated mount options into mount flags
+// and filesystem specific data.
+func parseMountOptions(opts string) (uintptr, string) {
+	var flags uintptr
+	var data []string
+	for _, o := range splitList(opts) {
+		if f, ok := mountOptions[o]; ok {
+			flags |= f
+		} else {
+			data = append(data, o)
+		}
+	}
+	return flags, strings.Join(data, ",")
+}
+
+// setup prepares and mounts the disk. It returns errDiskMissing if not all
+// devices are attached yet.
+func (d *diskConfig) setup() error {
+	if isMounted(d.MountPoint) {
+		return nil
+	}
+
+	var devs []string
+	for _, sel := range d.Devices {
+		dev, err := resolveDisk(sel)
+		if err != nil {
+			return err
+		}
+		devs = append(devs, dev)
+	}
+	dev := devs[0]
+	if len(devs) > 1 {
+		var err error
+		if dev, err = dmCreateStripe(d.Name, devs, uint64(d.ChunkKB)*2); err != nil {
+			return fmt.Errorf("striping %s: %v", strings.Join(devs, " "), err)
+		}
+	}
+
+	fs, err := probeFilesystem(dev)
+	if err != nil {
+		return err
+	}
+	fstype := d.FSType
+	switch {
+	case fs == nil && !d.Format:
+		return fmt.Errorf("%s has no filesystem and Format is not set", dev)
+	case fs == nil:
+		// A partition table is not a filesystem but neither is the disk
+		// empty.
+		if hasPartitions(dev) {
+			return fmt.Errorf("%s is partitioned, not formatting", dev)
+		}
+		logger.Printf("Formatting %s as %s", dev, fstype)
+		if err := mkfs(fstype, dev); err != nil {
+			return err
+		}
+	case fstype == "":
+		fstype = fs.Type
+	case strings.HasPrefix(fs.Type, "ext") && fstype == "ext4":
+		// ext4 mounts ext2 and ext3 filesystems.
+	case fs.Type != fstype:
+		return fmt.Errorf("%s has a %s filesystem, want %s", dev, fs.Type, fstype)
+	}
+
+	if err := os.MkdirAll(d.MountPoint, 0755); err != nil {
+		return err
+	}
+	flags, data := parseMountOptions(d.Options)
+	if err := unix.Mount(dev, d.MountPoint, fstype, flags, data); err != nil {
+		return fmt.Errorf("mounting %s on %s: %v", dev, d.MountPoint, err)
+	}
+	boot.event("disks", "Mounted %s (%s) on %s", dev, fstype, d.MountPoint)
+	events.publish("disk/mounted", map[string]string{"DEVICE": dev, "MOUNTPOINT": d.MountPoint, "FSTYPE": fstype})
+	return nil
+}
+
+// setupDisks sets up the disks in configs, returning the ones whose devices
+// are not all attached yet.
+func setupDisks(configs []*diskConfig) []*diskConfig {
+	var pending []*diskConfig
+	for _, d := range configs {
+		switch err := d.setup(); {
+		case err == errDiskMissing:
+			pending = append(pending, d)
+		case err != nil:
+			boot.fail("disks", fmt.Errorf("%s: %v", d.MountPoint, err))
+		}
+	}
+	return pending
+}
+
+// runDisks sets up the data disks from disksDirs that are attached. The
+// disks of the metadata attribute, which override those for the same mount
+// point not mounted yet, and the ones not attached are set up in the
+// background as the metadata server answers and their devices appear.
+func runDisks() {
+	// Subscribe first so that no device added meanwhile is missed.
+	c, cancel := events.subscribe()
+	pending := setupDisks(loadDiskConfigs())
+	go func() {
+		defer cancel()
+		md := metadataDiskConfigs()
+		override := map[string]bool{}
+		for _, d := range md {
+			override[d.MountPoint] = true
+		}
+		var keep []*diskConfig
+		for _, d := range pending {
+			if !override[d.MountPoint] {
+				keep = append(keep, d)
+			}
+		}
+		pending = append(keep, setupDisks(md)...)
+
+		for _, d := range pending {
+			logger.Printf("Waiting for disks %s for %s", strings.Join(d.Devices, " "), d.MountPoint)
+		}
+		for len(pending) > 0 {
+			e := <-c
+			if e.Type == "device/add" && e.Data["SUBSYSTEM"] == "block" {
+				pending = setupDisks(pending)
+			}
+		}
+	}()
+}
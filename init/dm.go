@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const dmControl = "/dev/mapper/control"
+
+// dmIoctl issues a device-mapper ioctl. buf starts with a unix.DmIoctl
+// header, the rest is the request's payload.
+func dmIoctl(req uintptr, name string, buf []byte, targets uint32, flags uint32) (*unix.DmIoctl, error) {
+	if len(buf) < unix.SizeofDmIoctl {
+		buf = make([]byte, unix.SizeofDmIoctl)
+	}
+	hdr := (*unix.DmIoctl)(unsafe.Pointer(&buf[0]))
+	hdr.Version = [3]uint32{unix.DM_VERSION_MAJOR, 0, 0}
+	hdr.Data_size = uint32(len(buf))
+	hdr.Data_start = unix.SizeofDmIoctl
+	hdr.Target_count = targets
+	hdr.Flags = flags
+	copy(hdr.Name[:unix.DM_NAME_LEN-1], name)
+
+	f, err := os.OpenFile(dmControl, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), req, uintptr(unsafe.Pointer(&buf[0]))); errno != 0 {
+		return nil, errno
+	}
+	return hdr, nil
+}
+
+// blockSectors returns the size of the block device at path in 512 byte
+// sectors.
+func blockSectors(path string) (uint64, error) {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(readSysFile(filepath.Join(sysRoot, "class/block", filepath.Base(real), "size")), 10, 64)
+}
+
+// dmCreateStripe creates a device-mapper device striping across devs (RAID0)
+// and returns its path. An existing device of the same name is reused.
+func dmCreateStripe(name string, devs []string, chunkSectors uint64) (string, error) {
+	var size uint64
+	for i, dev := range devs {
+		s, err := blockSectors(dev)
+		if err != nil {
+			return "", fmt.Errorf("size of %s: %v", dev, err)
+		}
+		if i == 0 || s < size {
+			size = s
+		}
+	}
+	size -= size % chunkSectors
+	if size == 0 {
+		return "", errors.New("devices smaller than one chunk")
+	}
+
+	hdr, err := dmIoctl(unix.DM_DEV_CREATE, name, nil, 0, 0)
+	if errors.Is(err, unix.EBUSY) {
+		if hdr, err = dmIoctl(unix.DM_DEV_STATUS, name, nil, 0, 0); err != nil {
+			return "", err
+		}
+		return dmDevicePath(hdr.Dev)
+	}
+	if err != nil {
+		return "", fmt.Errorf("creating %s: %v", name, err)
+	}
+
+	params := fmt.Sprintf("%d %d", len(devs), chunkSectors)
+	for _, dev := range devs {
+		params += " " + dev + " 0"
+	}
+	// The parameters are NUL terminated and padded to 8 bytes.
+	specLen := unix.SizeofDmTargetSpec + (len(params)+1+7)&^7
+	buf := make([]byte, unix.SizeofDmIoctl+specLen)
+	spec := (*unix.DmTargetSpec)(unsafe.Pointer(&buf[unix.SizeofDmIoctl]))
+	spec.Length = size * uint64(len(devs))
+	copy(spec.Target_type[:], "striped")
+	copy(buf[unix.SizeofDmIoctl+unix.SizeofDmTargetSpec:], params)
+
+	if _, err := dmIoctl(unix.DM_TABLE_LOAD, name, buf, 1, 0); err != nil {
+		dmIoctl(unix.DM_DEV_REMOVE, name, nil, 0, 0)
+		return "", fmt.Errorf("loading table for %s: %v", name, err)
+	}
+	// Resuming a device activates the loaded table.
+	if hdr, err = dmIoctl(unix.DM_DEV_SUSPEND, name, nil, 0, 0); err != nil {
+		dmIoctl(unix.DM_DEV_REMOVE, name, nil, 0, 0)
+		return "", fmt.Errorf("activating %s: %v", name, err)
+	}
+	return dmDevicePath(hdr.Dev)
+}
+
+// dmDevicePath waits for devtmpfs to create the node of a device-mapper
+// device.
+func dmDevicePath(dev uint64) (string, error) {
+	path := fmt.Sprintf("%s/dm-%d", devRoot, unix.Minor(dev))
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return "", fmt.Errorf("%s did not appear", path)
+}
+
+// dmName returns the device-mapper name of a block device, if any.
+func dmName(sysDev string) string {
+	return strings.TrimSpace(readSysFile(filepath.Join(sysDev, "dm/name")))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type event struct {
+	Time time.Time
+	Type string
+	Data map[string]string `json:",omitempty"`
+}
+
+// eventBus fans out events to subscribers. A subscriber that does not keep
+// up misses events rather than blocking the publisher.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan event]struct{}
+}
+
+var events = &eventBus{subs: map[chan event]struct{}{}}
+
+func (b *eventBus) publish(typ string, data map[string]string) {
+	e := event{Time: time.Now(), Type: typ, Data: data}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.subs {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel receiving all events published until cancel is
+// called.
+func (b *eventBus) subscribe() (<-chan event, func()) {
+	c := make(chan event, 100)
+	b.mu.Lock()
+	b.subs[c] = struct{}{}
+	b.mu.Unlock()
+	return c, func() {
+		b.mu.Lock()
+		delete(b.subs, c)
+		b.mu.Unlock()
+	}
+}
+
+// serveEvents streams events as JSON lines, the type query parameter limits
+// the stream to event types with that prefix.
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("type")
+	c, cancel := events.subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for {
+		select {
+		case e := <-c:
+			if !strings.HasPrefix(e.Type, prefix) {
+				continue
+			}
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// execEnv carries the execConfig from init to the exec helper.
+const execEnv = "ECL_EXEC_CONFIG"
+
+var capabilities = map[string]uintptr{
+	"CAP_CHOWN":              unix.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":             unix.CAP_FOWNER,
+	"CAP_FSETID":             unix.CAP_FSETID,
+	"CAP_KILL":               unix.CAP_KILL,
+	"CAP_SETGID":             unix.CAP_SETGID,
+	"CAP_SETUID":             unix.CAP_SETUID,
+	"CAP_SETPCAP":            unix.CAP_SETPCAP,
+	"CAP_LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"CAP_NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"CAP_NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"CAP_NET_RAW":            unix.CAP_NET_RAW,
+	"CAP_IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"CAP_SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"CAP_SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"CAP_SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"CAP_SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"CAP_SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"CAP_SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"CAP_SYS_NICE":           unix.CAP_SYS_NICE,
+	"CAP_SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":           unix.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"CAP_MKNOD":              unix.CAP_MKNOD,
+	"CAP_LEASE":              unix.CAP_LEASE,
+	"CAP_AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"CAP_AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"CAP_SETFCAP":            unix.CAP_SETFCAP,
+	"CAP_MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"CAP_MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"CAP_SYSLOG":             unix.CAP_SYSLOG,
+	"CAP_WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+	"CAP_BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+	"CAP_AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"CAP_PERFMON":            unix.CAP_PERFMON,
+	"CAP_BPF":                unix.CAP_BPF,
+	"CAP_CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// execConfig describes the privileges a service runs with. It is applied by
+// the exec helper, a mode of the init binary that runs between fork and the
+// service's own exec.
+type execConfig struct {
+	Path string
+	Args []string
+	Env  []string
+
+	UID, GID      int
+	Groups        []int
+	AmbientCaps   []uintptr
+	BoundingCaps  []uintptr
+	DropBounding  bool
+	NoNewPrivs    bool
+	SeccompAllow  []string
+	SeccompDeny   []string
+	ReadOnlyPaths []string
+	PrivateTmp    bool
+	Resources     resourceConfig
+}
+
+func newExecConfig() *execConfig {
+	return &execConfig{UID: -1, GID: -1}
+}
+
+// needsHelper reports whether the service can not be started directly.
+func (c *execConfig) needsHelper() bool {
+	return c.UID >= 0 || c.GID >= 0 || len(c.Groups) > 0 || len(c.AmbientCaps) > 0 ||
+		c.DropBounding || c.NoNewPrivs || len(c.SeccompAllow) > 0 || len(c.SeccompDeny) > 0 ||
+		c.needsMountNS() || c.Resources.isSet()
+}
+
+func (c *execConfig) needsMountNS() bool {
+	return len(c.ReadOnlyPaths) > 0 || c.PrivateTmp
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func parseBool(value string) (bool, error) {
+	return strconv.ParseBool(strings.ToLower(value))
+}
+
+// lookupUser and lookupGroup take numeric IDs only, the image has no
+// /etc/passwd or /etc/group to resolve names in. A user's group defaults to
+// the gid equal to its uid.
+func lookupUser(name string) (int, int, error) {
+	uid, err := strconv.Atoi(name)
+	if err != nil || uid < 0 {
+		return 0, 0, fmt.Errorf("user %q is not a numeric uid, there is no /etc/passwd", name)
+	}
+	return uid, uid, nil
+}
+
+func lookupGroup(name string) (int, error) {
+	gid, err := strconv.Atoi(name)
+	if err != nil || gid < 0 {
+		return 0, fmt.Errorf("group %q is not a numeric gid, there is no /etc/group", name)
+	}
+	return gid, nil
+}
+
+func parseCaps(value string) ([]uintptr, error) {
+	var caps []uintptr
+	for _, name := range splitList(value) {
+		name = strings.ToUpper(name)
+		if !strings.HasPrefix(name, "CAP_") {
+			name = "CAP_" + name
+		}
+		c, ok := capabilities[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		caps = append(caps, c)
+	}
+	return caps, nil
+}
+
+// parseDirective handles the privilege and resource directives of a service
+// file. It returns false if key is not one of them.
+func (c *execConfig) parseDirective(key, value string) (bool, error) {
+	var err error
+	switch key {
+	case "USER":
+		var gid int
+		if c.UID, gid, err = lookupUser(value); err == nil && c.GID < 0 {
+			c.GID = gid
+		}
+	case "GROUP":
+		c.GID, err = lookupGroup(value)
+	case "SUPPLEMENTARY_GROUPS":
+		for _, g := range splitList(value) {
+			gid, err := lookupGroup(g)
+			if err != nil {
+				return true, err
+			}
+			c.Groups = append(c.Groups, gid)
+		}
+	case "CAPABILITIES_AMBIENT":
+		c.AmbientCaps, err = parseCaps(value)
+	case "CAPABILITIES_BOUNDING":
+		c.DropBounding = true
+		c.BoundingCaps, err = parseCaps(value)
+	case "NO_NEW_PRIVS":
+		c.NoNewPrivs, err = parseBool(value)
+	case "SECCOMP_ALLOW":
+		c.SeccompAllow = splitList(value)
+	case "SECCOMP_DENY":
+		c.SeccompDeny = splitList(value)
+	case "READ_ONLY_PATHS":
+		c.ReadOnlyPaths = splitList(value)
+	case "PRIVATE_TMP":
+		c.PrivateTmp, err = parseBool(value)
+	default:
+		return c.Resources.parseDirective(key, value)
+	}
+	if err != nil {
+		return true, fmt.Errorf("bad %s: %v", key, err)
+	}
+	return true, nil
+}
+
+// validate catches configuration errors before the service is started.
+func (c *execConfig) validate() error {
+	if len(c.SeccompAllow) > 0 || len(c.SeccompDeny) > 0 {
+		if _, err := compileSeccomp(c.SeccompAllow, c.SeccompDeny); err != nil {
+			return err
+		}
+	}
+	if len(c.SeccompAllow) > 0 {
+		found := false
+		for _, s := range c.SeccompAllow {
+			found = found || s == "execve"
+		}
+		if !found {
+			return fmt.Errorf("SECCOMP_ALLOW must include execve")
+		}
+	}
+	if c.DropBounding {
+		for _, a := range c.AmbientCaps {
+			found := false
+			for _, b := range c.BoundingCaps {
+				found = found || a == b
+			}
+			if !found {
+				return fmt.Errorf("ambient capability %d is not in the bounding set", a)
+			}
+		}
+	}
+	return nil
+}
+
+// sysProcAttr returns the attributes applied by the kernel before the exec
+// helper runs.
+func (c *execConfig) sysProcAttr() *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{}
+	if c.needsMountNS() {
+		attr.Unshareflags = syscall.CLONE_NEWNS
+	}
+	return attr
+}
+
+func (c *execConfig) setupMounts() error {
+	if !c.needsMountNS() {
+		return nil
+	}
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making / private: %v", err)
+	}
+	if c.PrivateTmp {
+		if err := unix.Mount("tmpfs", "/tmp", "tmpfs", nodev|nosuid, "mode=1777"); err != nil {
+			return fmt.Errorf("mounting private /tmp: %v", err)
+		}
+	}
+	for _, p := range c.ReadOnlyPaths {
+		if err := unix.Mount(p, p, "", bind|rec, ""); err != nil {
+			return fmt.Errorf("binding %s: %v", p, err)
+		}
+		if err := unix.Mount("", p, "", bind|remount|readonly, ""); err != nil {
+			return fmt.Errorf("remounting %s read-only: %v", p, err)
+		}
+	}
+	return nil
+}
+
+func (c *execConfig) dropBounding() error {
+	if !c.DropBounding {
+		return nil
+	}
+	keep := map[uintptr]bool{}
+	for _, b := range c.BoundingCaps {
+		keep[b] = true
+	}
+	for cap := uintptr(0); cap <= unix.CAP_LAST_CAP; cap++ {
+		if keep[cap] {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, cap, 0, 0, 0); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("dropping capability %d: %v", cap, err)
+		}
+	}
+	return nil
+}
+
+func (c *execConfig) setCredentials() error {
+	if c.UID < 0 && c.GID < 0 && len(c.Groups) == 0 {
+		return nil
+	}
+	// Keep the permitted set across the uid change so the ambient set
+	// can be raised afterwards.
+	if len(c.AmbientCaps) > 0 {
+		if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Setgroups(c.Groups); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if c.GID >= 0 {
+		if err := syscall.Setresgid(c.GID, c.GID, c.GID); err != nil {
+			return fmt.Errorf("setgid: %v", err)
+		}
+	}
+	if c.UID >= 0 {
+		if err := syscall.Setresuid(c.UID, c.UID, c.UID); err != nil {
+			return fmt.Errorf("setuid: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c *execConfig) raiseAmbient() error {
+	if len(c.AmbientCaps) == 0 {
+		return nil
+	}
+	var data [2]unix.CapUserData
+	for _, cap := range c.AmbientCaps {
+		data[cap/32].Effective |= 1 << (cap % 32)
+		data[cap/32].Permitted |= 1 << (cap % 32)
+		data[cap/32].Inheritable |= 1 << (cap % 32)
+	}
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("capset: %v", err)
+	}
+	for _, cap := range c.AmbientCaps {
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, cap, 0, 0); err != nil {
+			return fmt.Errorf("raising ambient capability %d: %v", cap, err)
+		}
+	}
+	return nil
+}
+
+// apply sets up the calling thread and execs the service, it only returns
+// on error.
+func (c *execConfig) apply() error {
+	// Capabilities are per thread, everything from here to exec has to
+	// happen on this one.
+	runtime.LockOSThread()
+
+	steps := []func() error{
+		c.setupMounts,
+		c.Resources.apply,
+		c.dropBounding,
+		c.setCredentials,
+		c.raiseAmbient,
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+
+	var prog []unix.SockFilter
+	if len(c.SeccompAllow) > 0 || len(c.SeccompDeny) > 0 {
+		var err error
+		if prog, err = compileSeccomp(c.SeccompAllow, c.SeccompDeny); err != nil {
+			return err
+		}
+		// Required to install a filter without CAP_SYS_ADMIN.
+		c.NoNewPrivs = c.NoNewPrivs || c.UID > 0
+	}
+	if c.NoNewPrivs {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("setting no_new_privs: %v", err)
+		}
+	}
+	if prog != nil {
+		if err := installSeccomp(prog); err != nil {
+			return fmt.Errorf("installing seccomp filter: %v", err)
+		}
+	}
+
+	return unix.Exec(c.Path, c.Args, c.Env)
+}
+
+// execHelper is the entry point of the exec helper, the config is read from
+// the environment.
+func execHelper(_ []string) int {
+	c := newExecConfig()
+	if err := json.Unmarshal([]byte(os.Getenv(execEnv)), c); err != nil {
+		fmt.Fprintln(os.Stderr, "exec helper: bad config:", err)
+		return 1
+	}
+	err := c.apply()
+	fmt.Fprintf(os.Stderr, "exec helper: %s: %v\n", c.Path, err)
+	return 1
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// hostsFile and resolvFile are generated, /etc/hosts and /etc/resolv.conf
+// link to them.
+var (
+	hostsFile  = "/run/hosts"
+	resolvFile = "/run/resolv.conf"
+)
+
+const (
+	attributesPath  = "instance/attributes/?recursive=true"
+	metadataAddress = "169.254.169.254"
+)
+
+type hostConfig struct {
+	FQDN        string
+	Address     string
+	Nameservers []string
+	Search      []string
+}
+
+// hostManager keeps the hostname, hosts and resolv.conf in line with DHCP
+// and the metadata server. The hostname attribute overrides the instance's
+// name.
+type hostManager struct {
+	dhcpName    string // option 12, set by the kernel's DHCP client
+	dhcpDomain  string
+	nameservers []string
+
+	instanceName string
+	address      string
+	current      hostConfig
+}
+
+// readPNP parses the DHCP results the kernel exports in /proc/net/pnp.
+func readPNP() (domain string, nameservers []string) {
+	lines, _ := readConfLines("/proc/net/pnp")
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "domain":
+			domain = fields[1]
+		case "nameserver":
+			if fields[1] != "0.0.0.0" {
+				nameservers = append(nameservers, fields[1])
+			}
+		}
+	}
+	return domain, nameservers
+}
+
+// primaryAddress returns the first global IPv4 address of the host.
+func primaryAddress() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil && n.IP.IsGlobalUnicast() {
+			return n.IP.String()
+		}
+	}
+	return ""
+}
+
+// searchDomains derives the search list from the host's domain. On GCE
+// the zonal domain "zone.c.project.internal" also searches the project wide
+// "c.project.internal".
+func searchDomains(domain string) []string {
+	if domain == "" {
+		return nil
+	}
+	search := []string{domain}
+	labels := strings.Split(domain, ".")
+	if len(labels) == 4 && labels[1] == "c" && labels[3] == "internal" {
+		search = append(search, strings.Join(labels[1:], "."))
+	}
+	if strings.HasSuffix(domain, ".internal") && domain != "google.internal" {
+		search = append(search, "google.internal")
+	}
+	return search
+}
+
+func newHostManager() *hostManager {
+	m := &hostManager{}
+	if b, err := ioutil.ReadFile("/proc/sys/kernel/hostname"); err == nil {
+		if name := strings.TrimSpace(string(b)); name != "(none)" && name != "" {
+			m.dhcpName = name
+		}
+	}
+	m.dhcpDomain, m.nameservers = readPNP()
+	if len(m.nameservers) == 0 {
+		m.nameservers = []string{metadataAddress}
+	}
+	m.address = primaryAddress()
+	return m
+}
+
+// readMetadata fills in the instance's name and address from the metadata
+// server, which may take until the metadata client times out.
+func (m *hostManager) readMetadata() {
+	m.instanceName, _ = getMetadata("instance/hostname")
+	if address, _ := getMetadata("instance/network-interfaces/0/ip"); address != "" {
+		m.address = address
+	}
+}
+
+// config returns the configuration for the given hostname attribute.
+func (m *hostManager) config(attr string) hostConfig {
+	fqdn := strings.TrimSpace(attr)
+	if fqdn == "" {
+		fqdn = m.instanceName
+	}
+	if fqdn == "" {
+		fqdn = m.dhcpName
+		if fqdn != "" && m.dhcpDomain != "" && !strings.Contains(fqdn, ".") {
+			fqdn += "." + m.dhcpDomain
+		}
+	}
+	fqdn = strings.TrimSuffix(fqdn, ".")
+	var domain string
+	if i := strings.IndexByte(fqdn, '.'); i >= 0 {
+		domain = fqdn[i+1:]
+	} else {
+		domain = m.dhcpDomain
+	}
+	return hostConfig{
+		FQDN:        fqdn,
+		Address:     m.address,
+		Nameservers: m.nameservers,
+		Search:      searchDomains(domain),
+	}
+}
+
+func (c hostConfig) shortName() string {
+	return strings.SplitN(c.FQDN, ".", 2)[0]
+}
+
+func (c hostConfig) hosts() []byte {
+	var b bytes.Buffer
+	b.WriteString("# Generated by init, do not edit.\n")
+	b.WriteString("127.0.0.1       localhost\n")
+	b.WriteString("::1             localhost ip6-localhost ip6-loopback\n")
+	b.WriteString("ff02::1         ip6-allnodes\n")
+	b.WriteString("ff02::2         ip6-allrouters\n\n")
+	if c.Address != "" && c.FQDN != "" {
+		if short := c.shortName(); short != c.FQDN {
+			fmt.Fprintf(&b, "%-15s %s %s\n", c.Address, c.FQDN, short)
+		} else {
+			fmt.Fprintf(&b, "%-15s %s\n", c.Address, c.FQDN)
+		}
+	}
+	fmt.Fprintf(&b, "%-15s metadata.google.internal\n", metadataAddress)
+	return b.Bytes()
+}
+
+func (c hostConfig) resolvConf() []byte {
+	var b bytes.Buffer
+	b.WriteString("# Generated by init, do not edit.\n")
+	for _, ns := range c.Nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	if len(c.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(c.Search, " "))
+	}
+	return b.Bytes()
+}
+
+// writeIfChanged rewrites path in place if its contents differ. The file is
+// not replaced since containers bind mount it.
+func writeIfChanged(path string, data []byte) error {
+	if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, data) {
+		return nil
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func (m *hostManager) apply(c hostConfig) {
+	if c.FQDN != "" && c.FQDN != m.current.FQDN {
+		if err := unix.Sethostname([]byte(c.shortName())); err != nil {
+			boot.fail("hostname", fmt.Errorf("setting hostname: %v", err))
+		} else {
+			boot.event("hostname", "Hostname set to %s (%s)", c.shortName(), c.FQDN)
+		}
+	}
+	if err := writeIfChanged(hostsFile, c.hosts()); err != nil {
+		boot.fail("hostname", err)
+	}
+	if err := writeIfChanged(resolvFile, c.resolvConf()); err != nil {
+		boot.fail("hostname", err)
+	}
+	if c.FQDN != m.current.FQDN {
+		events.publish("host/hostname", map[string]string{"HOSTNAME": c.shortName(), "FQDN": c.FQDN})
+	}
+	m.current = c
+}
+
+func hostnameAttribute(attrs string) string {
+	var a struct {
+		Hostname string `json:"hostname"`
+	}
+	json.Unmarshal([]byte(attrs), &a)
+	return a.Hostname
+}
+
+// runHostname sets up the hostname, hosts and resolv.conf from DHCP, then
+// in the background from the metadata server, and follows changes of the
+// hostname attribute.
+func runHostname() {
+	m := newHostManager()
+	m.apply(m.config(""))
+
+	go func() {
+		m.readMetadata()
+		attrs, etag, err := fetchMetadata(metadataClient, attributesPath)
+		if err != nil {
+			etag = defaultEtag
+			if !errors.Is(err, os.ErrNotExist) {
+				logger.Printf("Error reading instance attributes: %v", err)
+			}
+		}
+		m.apply(m.config(hostnameAttribute(attrs)))
+
+		backoff := time.Second
+		for {
+			attrs, newEtag, err := watchMetadata(attributesPath, etag)
+			if err != nil {
+				time.Sleep(backoff)
+				if backoff < 5*time.Minute {
+					backoff *= 2
+				}
+				continue
+			}
+			backoff = time.Second
+			etag = newEtag
+			if m.instanceName == "" {
+				m.instanceName, _ = getMetadata("instance/hostname")
+			}
+			m.apply(m.config(hostnameAttribute(attrs)))
+		}
+	}()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/adjackura/ecl/internal/logpipe"
+)
+
+// logs keeps writers from blocking on the console.
+var logs = logpipe.New(os.Stdout, dropMarker)
+
+// dropMarker is the line reporting n lines of name were dropped.
+func dropMarker(name string, n int) string {
+	return fmt.Sprintf("[ %f ] [%s] %d lines dropped\n", time.Since(start).Seconds(), name, n)
+}
+
+type consoleWriter struct {
+	name string
+}
+
+func (w *consoleWriter) Write(b []byte) (int, error) {
+	t := time.Since(start).Seconds()
+	var msg string
+	lines := bytes.Split(bytes.TrimRight(b, "\n"), []byte("\n"))
+	for _, b := range lines {
+		msg += fmt.Sprintf("[ %f ] [%s] %s\n", t, w.name, b)
+	}
+	logs.Write(w.name, msg, len(lines))
+	if w.name == "init" {
+		writePmsg(msg)
+	}
+	return len(b), nil
+}
+
+func setupLogging() {
+	// mount proc filesystem
+	mount("proc", "/proc", "proc", nodev|nosuid|noexec|relatime, "")
+
+	f, err := os.Open("/proc/uptime")
+	if err == nil {
+		defer f.Close()
+		d, err := io.ReadAll(f)
+		if err == nil {
+			uptime := bytes.Split(d, []byte(" "))[0]
+			u, err := strconv.ParseFloat(string(uptime), 32)
+			if err == nil {
+				start = start.Add(-time.Duration(int(u*1000)) * time.Millisecond)
+			}
+		}
+	}
+
+	go logs.Run()
+}
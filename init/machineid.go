@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// machineIDFile and randomSeedFile live on the stateful partition, the
+	// root filesystem is the same on every boot.
+	machineIDFile  = "/var/lib/ecl/machine-id"
+	randomSeedFile = "/var/lib/ecl/random-seed"
+)
+
+// randomSeedSize matches the size of the kernel's input pool.
+const randomSeedSize = 512
+
+// rndAddEntropy is RNDADDENTROPY, _IOW('R', 0x03, int[2]).
+const rndAddEntropy = 0x40085203
+
+// writeFileAtomic replaces path with data so that a crash leaves either the
+// old or the new contents.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func validMachineID(id string) bool {
+	if len(id) != 32 || strings.ToLower(id) != id {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil && id != strings.Repeat("0", 32)
+}
+
+// newMachineID returns a random machine-id formatted like a version 4 UUID
+// without dashes, as systemd does.
+func newMachineID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := unix.Getrandom(b, 0); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return hex.EncodeToString(b), nil
+}
+
+// setupMachineID bind mounts the machine-id stored on the stateful partition
+// over /etc/machine-id, generating it on first boot.
+func setupMachineID() error {
+	b, err := ioutil.ReadFile(machineIDFile)
+	id := strings.TrimSpace(string(b))
+	if err != nil || !validMachineID(id) {
+		if err != nil && !os.IsNotExist(err) {
+			logger.Printf("Error reading %s: %v", machineIDFile, err)
+		}
+		if id, err = newMachineID(); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(machineIDFile, []byte(id+"\n"), 0444); err != nil {
+			return err
+		}
+		boot.event("machine-id", "Generated machine-id %s", id)
+	}
+	if err := unix.Mount(machineIDFile, "/etc/machine-id", "", bind, ""); err != nil {
+		return fmt.Errorf("binding %s: %v", machineIDFile, err)
+	}
+	if err := unix.Mount("", "/etc/machine-id", "", bind|remount|readonly, ""); err != nil {
+		return fmt.Errorf("remounting /etc/machine-id read-only: %v", err)
+	}
+	logger.Println("Machine ID:", id)
+	return nil
+}
+
+// creditRandomSeed adds seed to the kernel's entropy pool and credits it.
+func creditRandomSeed(seed []byte) error {
+	f, err := os.OpenFile("/dev/urandom", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// struct rand_pool_info { int entropy_count; int buf_size; __u32 buf[]; }
+	info := make([]byte, 8+len(seed))
+	binary.LittleEndian.PutUint32(info[0:], uint32(len(seed)*8))
+	binary.LittleEndian.PutUint32(info[4:], uint32(len(seed)))
+	copy(info[8:], seed)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), rndAddEntropy, uintptr(unsafe.Pointer(&info[0]))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// saveRandomSeed writes a new seed from the kernel's pool for the next boot.
+func saveRandomSeed() error {
+	seed := make([]byte, randomSeedSize)
+	if _, err := unix.Getrandom(seed, unix.GRND_NONBLOCK); err == unix.EAGAIN {
+		logger.Println("Random pool not initialized, not saving a seed")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return writeFileAtomic(randomSeedFile, seed, 0600)
+}
+
+// loadRandomSeed credits the seed saved by the previous boot and replaces it
+// right away, so that a crash before shutdown does not reuse it.
+func loadRandomSeed() error {
+	seed, err := ioutil.ReadFile(randomSeedFile)
+	switch {
+	case os.IsNotExist(err):
+		logger.Println("No random seed, not crediting entropy")
+	case err != nil:
+		return err
+	case len(seed) > 0:
+		if err := creditRandomSeed(seed); err != nil {
+			return fmt.Errorf("crediting random seed: %v", err)
+		}
+		logger.Printf("Credited %d bytes of random seed", len(seed))
+	}
+	return saveRandomSeed()
+}
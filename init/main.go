@@ -1,27 +1,22 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/sys/unix"
 )
 
 var (
-	writerChan = make(chan string, 100)
-	logger     = log.New(&consoleWriter{name: "init"}, "", log.LstdFlags|log.Lmicroseconds)
-	start      = time.Now()
+	logger = log.New(&consoleWriter{name: "init"}, "", log.LstdFlags|log.Lmicroseconds)
+	start  = time.Now()
 )
 
 const (
@@ -36,47 +31,6 @@ const (
 	bind     = unix.MS_BIND
 )
 
-type consoleWriter struct {
-	name string
-}
-
-func (w *consoleWriter) Write(b []byte) (int, error) {
-	t := time.Since(start).Seconds()
-	var msg string
-	for _, b := range bytes.Split(bytes.TrimRight(b, "\n"), []byte("\n")) {
-		msg += fmt.Sprintf("[ %f ] [%s] %s\n", t, w.name, b)
-	}
-	writerChan <- msg
-	return len(b), nil
-}
-
-func setupLogging() {
-	// mount proc filesystem
-	mount("proc", "/proc", "proc", nodev|nosuid|noexec|relatime, "")
-
-	f, err := os.Open("/proc/uptime")
-	if err == nil {
-		defer f.Close()
-		d, err := io.ReadAll(f)
-		if err == nil {
-			uptime := bytes.Split(d, []byte(" "))[0]
-			u, err := strconv.ParseFloat(string(uptime), 32)
-			if err == nil {
-				start = start.Add(-time.Duration(int(u*1000)) * time.Millisecond)
-			}
-		}
-	}
-
-	go func() {
-		for {
-			select {
-			case s := <-writerChan:
-				os.Stdout.WriteString(s)
-			}
-		}
-	}()
-}
-
 func mount(source string, target string, fstype string, flags uintptr, data string) {
 	if err := unix.Mount(source, target, fstype, flags, data); err != nil {
 		logger.Printf("error mounting %s to %s: %v", source, target, err)
@@ -102,7 +56,58 @@ func write(path string, value string) {
 	}
 }
 
+// confFiles returns the files ending in suffix from dirs sorted by name. A
+// file in a later directory replaces the one of the same name in an earlier
+// directory.
+func confFiles(dirs []string, suffix string) []string {
+	files := map[string]string{}
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Printf("error reading %s: %v", dir, err)
+			}
+			continue
+		}
+		for _, e := range entries {
+			if !e.IsDir() && strings.HasSuffix(e.Name(), suffix) {
+				files[e.Name()] = filepath.Join(dir, e.Name())
+			}
+		}
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var paths []string
+	for _, name := range names {
+		paths = append(paths, files[name])
+	}
+	return paths
+}
+
+// isMounted reports whether a filesystem is mounted at target.
+func isMounted(target string) bool {
+	lines, err := readConfLines("/proc/self/mounts")
+	if err != nil {
+		return false
+	}
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[1] == target {
+			return true
+		}
+	}
+	return false
+}
+
 func mounts() {
+	// the kernel only mounts devtmpfs itself with CONFIG_DEVTMPFS_MOUNT
+	if !isMounted("/dev") {
+		mount("devtmpfs", "/dev", "devtmpfs", nosuid|noexec, "mode=0755")
+	}
+
 	mount("/dev/sda4", "/mnt", "ext4", nodev|nosuid|relatime, "")
 	mount("/mnt/var", "/var", "", bind, "")
 	mount("/mnt/opt", "/opt", "", bind, "")
@@ -118,6 +123,7 @@ func mounts() {
 	mkdir("/var/cache", 0755)
 	mkdir("/var/empty", 0555)
 	mkdir("/var/lib", 0755)
+	mkdir("/var/lib/ecl/init.d", 0755)
 	mkdir("/var/local", 0755)
 	mkdir("/var/lock", 0755)
 	mkdir("/var/log", 0755)
@@ -139,34 +145,25 @@ func mounts() {
 	mount("cgroup2", "/sys/fs/cgroup", "cgroup2", noexec|nosuid|nodev, "")
 }
 
-type systemService struct {
-	name, path string
-	args       []string
+// subcommands are modes of the init binary used when it is not PID 1.
+var subcommands = map[string]func(args []string) int{
+	"exec":     execHelper,
+	"coredump": coredumpHelper,
+	"dev":      devMode,
 }
 
-func (s *systemService) start() error {
-	cmd := exec.Command(s.path, s.args...)
-	cmd.Env = []string{"PATH=/usr/sbin:/usr/bin:/sbin:/bin:/usr/local/bin:/usr/local/sbin:/opt/bin"}
-	w := &consoleWriter{name: s.name}
-	cmd.Stdout = w
-	cmd.Stderr = w
-
-	if err := cmd.Start(); err != nil {
-		logger.Fatalln(err)
-	}
-
-	go func() {
-		if err := cmd.Wait(); err != nil {
-			logger.Println(err)
+func main() {
+	if os.Getpid() != 1 && len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
 		}
-		s.start()
-	}()
-	return nil
-}
+	}
 
-var systemServices = map[string]*systemService{}
+	if os.Getenv(devEnv) != "" {
+		runDev()
+		return
+	}
 
-func main() {
 	os.Stdout.WriteString("Starting AgileOS...\n")
 	setupLogging()
 	cmdline, _ := ioutil.ReadFile("/proc/cmdline")
@@ -175,6 +172,41 @@ func main() {
 	logger.Println("Mounting all the things")
 	mounts()
 
+	if err := collectPstore(); err != nil {
+		boot.fail("pstore", err)
+	}
+	openPmsg()
+
+	if err := setupMachineID(); err != nil {
+		boot.fail("machine-id", err)
+	}
+	if err := loadRandomSeed(); err != nil {
+		boot.fail("random-seed", err)
+	}
+
+	logger.Println("Loading kernel modules")
+	loadModules()
+
+	logger.Println("Applying sysctl settings")
+	applySysctl()
+
+	logger.Println("Setting up memory")
+	setupMemory()
+
+	logger.Println("Running device manager")
+	if err := runDevices(); err != nil {
+		boot.fail("devices", err)
+	}
+
+	logger.Println("Setting up data disks")
+	runDisks()
+
+	logger.Println("Configuring hostname")
+	runHostname()
+
+	logger.Println("Running time synchronization")
+	go runTimesync()
+
 	logger.Println("Running ACPI listener")
 	go func() {
 		if err := runACPIListener(); err != nil {
@@ -183,54 +215,28 @@ func main() {
 		}
 	}()
 
-	logger.Println("Reading core service files")
-	svcFileDir := "/etc/init"
-	svcFiles, err := ioutil.ReadDir(svcFileDir)
-	if err != nil {
-		logger.Fatal(err)
-	}
+	runServices()
+}
 
-	for _, svcFile := range svcFiles {
-		if svcFile.IsDir() {
-			continue
-		}
-		file := filepath.Join(svcFileDir, svcFile.Name())
-		f, err := os.Open(file)
-		if err != nil {
-			logger.Printf("Error opening service file %s: %v", file, err)
-			continue
-		}
-		scanner := bufio.NewScanner(f)
-		var svc systemService
-		for scanner.Scan() {
-			entry := strings.SplitN(scanner.Text(), "=", 2)
-			if len(entry) != 2 {
-				continue
-			}
-			switch entry[0] {
-			case "NAME":
-				svc.name = strings.Trim(entry[1], `"`)
-			case "PATH":
-				svc.path = strings.Trim(entry[1], `"`)
-			case "ARGS":
-				svc.args = strings.Split(strings.Replace(entry[1], " ", "", -1), ",")
-			}
+// runServices serves the control interface, starts the services and reloads
+// them on SIGHUP.
+func runServices() {
+	logger.Println("Running control interface")
+	go func() {
+		if err := runControl(); err != nil {
+			logger.Println("Error running control interface:", err)
 		}
+	}()
 
-		systemServices[svcFile.Name()] = &svc
-	}
-
-	var keys []string
-	for k := range systemServices {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
+	logger.Println("Reading core service files")
+	systemServices := loadServices(svcDirs)
 
 	logger.Println("Starting services")
-	for _, k := range keys {
-		logger.Println("Starting", systemServices[k].name)
-		systemServices[k].start()
-	}
+	services.apply(systemServices)
 
-	select {}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		services.reload()
+	}
 }
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// memoryDirs hold *.conf files of KEY=VALUE lines, later files override
+// earlier ones:
+//
+//	ZRAM_SIZE           size of the zram swap device, bytes with an optional
+//	                    K, M or G suffix or a percentage of RAM
+//	ZRAM_ALGORITHM      compression algorithm, e.g. lz4 or zstd
+//	ZRAM_PRIORITY       swap priority, default 100
+//	SWAPPINESS          vm.swappiness
+//	PRESSURE            PSI trigger, "some|full <stall> <window>"
+//	PRESSURE_ACTIONS    taken on sustained pressure: drop-caches, restart:<service>
+//	PRESSURE_COOLDOWN   minimum time between actions, default 1m
+var memoryDirs = []string{"/etc/memory.d", "/var/lib/ecl/memory.d"}
+
+const (
+	swapFlagPrefer = 0x8000
+	// swapPageSize is the page size written to the swap header.
+	swapPageSize = 4096
+)
+
+type memoryConfig struct {
+	zramSize      string
+	zramAlgorithm string
+	zramPriority  int
+	swappiness    string
+
+	pressureKind     string
+	pressureStall    time.Duration
+	pressureWindow   time.Duration
+	pressureActions  []string
+	pressureCooldown time.Duration
+}
+
+func (c *memoryConfig) parseDirective(key, value string) error {
+	var err error
+	switch key {
+	case "ZRAM_SIZE":
+		c.zramSize = value
+	case "ZRAM_ALGORITHM":
+		c.zramAlgorithm = value
+	case "ZRAM_PRIORITY":
+		if c.zramPriority, err = strconv.Atoi(value); err != nil || c.zramPriority < 0 || c.zramPriority > 0x7fff {
+			return fmt.Errorf("bad ZRAM_PRIORITY %q", value)
+		}
+	case "SWAPPINESS":
+		if n, err := strconv.Atoi(value); err != nil || n < 0 || n > 200 {
+			return fmt.Errorf("bad SWAPPINESS %q", value)
+		}
+		c.swappiness = value
+	case "PRESSURE":
+		fields := strings.Fields(value)
+		if len(fields) != 3 || (fields[0] != "some" && fields[0] != "full") {
+			return fmt.Errorf("bad PRESSURE %q", value)
+		}
+		c.pressureKind = fields[0]
+		if c.pressureStall, err = time.ParseDuration(fields[1]); err != nil {
+			return fmt.Errorf("bad PRESSURE stall: %v", err)
+		}
+		if c.pressureWindow, err = time.ParseDuration(fields[2]); err != nil {
+			return fmt.Errorf("bad PRESSURE window: %v", err)
+		}
+		// The kernel's limits for triggers.
+		if c.pressureWindow < 500*time.Millisecond || c.pressureWindow > 10*time.Second || c.pressureStall > c.pressureWindow {
+			return fmt.Errorf("bad PRESSURE %q: window must be 500ms to 10s and not below the stall", value)
+		}
+	case "PRESSURE_ACTIONS":
+		c.pressureActions = splitList(value)
+		for _, a := range c.pressureActions {
+			if a != "drop-caches" && !strings.HasPrefix(a, "restart:") {
+				return fmt.Errorf("unknown pressure action %q", a)
+			}
+		}
+	case "PRESSURE_COOLDOWN":
+		if c.pressureCooldown, err = time.ParseDuration(value); err != nil {
+			return fmt.Errorf("bad PRESSURE_COOLDOWN: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown key %s", key)
+	}
+	return nil
+}
+
+func loadMemoryConfig() *memoryConfig {
+	c := &memoryConfig{zramPriority: 100, pressureCooldown: time.Minute}
+	for _, file := range confFiles(memoryDirs, ".conf") {
+		lines, err := readConfLines(file)
+		if err != nil {
+			boot.fail("memory", err)
+			continue
+		}
+		for _, line := range lines {
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				boot.fail("memory", fmt.Errorf("%s: bad line %q", file, line))
+				continue
+			}
+			if err := c.parseDirective(strings.TrimSpace(kv[0]), strings.Trim(strings.TrimSpace(kv[1]), `"`)); err != nil {
+				boot.fail("memory", fmt.Errorf("%s: %v", file, err))
+			}
+		}
+	}
+	return c
+}
+
+// parseMemorySize parses a size in bytes with an optional K, M or G suffix or
+// a percentage of total.
+func parseMemorySize(value string, total uint64) (uint64, error) {
+	if strings.HasSuffix(value, "%") {
+		p, err := strconv.ParseUint(strings.TrimSuffix(value, "%"), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return total / 100 * p, nil
+	}
+	shift := 0
+	switch {
+	case strings.HasSuffix(value, "K"):
+		shift = 10
+	case strings.HasSuffix(value, "M"):
+		shift = 20
+	case strings.HasSuffix(value, "G"):
+		shift = 30
+	}
+	if shift > 0 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	return n << shift, err
+}
+
+// mkswap writes a swap header to dev, which is size bytes.
+func mkswap(dev string, size uint64) error {
+	f, err := os.OpenFile(dev, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, swapPageSize)
+	// version, last page and number of bad pages follow the 1024 byte
+	// boot block.
+	binary.LittleEndian.PutUint32(hdr[1024:], 1)
+	binary.LittleEndian.PutUint32(hdr[1028:], uint32(size/swapPageSize-1))
+	if _, err := unix.Getrandom(hdr[1036:1052], 0); err != nil {
+		return err
+	}
+	copy(hdr[swapPageSize-10:], "SWAPSPACE2")
+	if _, err := f.WriteAt(hdr, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func swapon(dev string, priority int) error {
+	p, err := unix.BytePtrFromString(dev)
+	if err != nil {
+		return err
+	}
+	flags := swapFlagPrefer | priority&0x7fff
+	if _, _, errno := unix.Syscall(unix.SYS_SWAPON, uintptr(unsafe.Pointer(p)), uintptr(flags), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setupZram configures a zram device of the configured size and enables it
+// as swap.
+func (c *memoryConfig) setupZram() error {
+	var si unix.Sysinfo_t
+	if err := unix.Sysinfo(&si); err != nil {
+		return err
+	}
+	size, err := parseMemorySize(c.zramSize, uint64(si.Totalram)*uint64(si.Unit))
+	if err != nil {
+		return fmt.Errorf("bad ZRAM_SIZE %q: %v", c.zramSize, err)
+	}
+	size -= size % swapPageSize
+	if size < 2*swapPageSize {
+		return fmt.Errorf("ZRAM_SIZE %q is too small", c.zramSize)
+	}
+
+	sysDev := filepath.Join(sysRoot, "block/zram0")
+	if _, err := os.Stat(sysDev); err != nil {
+		return fmt.Errorf("no zram device: %v", err)
+	}
+	if c.zramAlgorithm != "" {
+		if err := writeSysctl(filepath.Join(sysDev, "comp_algorithm"), c.zramAlgorithm); err != nil {
+			return fmt.Errorf("setting compression algorithm %s: %v", c.zramAlgorithm, err)
+		}
+	}
+	if err := writeSysctl(filepath.Join(sysDev, "disksize"), strconv.FormatUint(size, 10)); err != nil {
+		return fmt.Errorf("setting disk size: %v", err)
+	}
+
+	dev := filepath.Join(devRoot, "zram0")
+	if err := mkswap(dev, size); err != nil {
+		return fmt.Errorf("writing swap header: %v", err)
+	}
+	if err := swapon(dev, c.zramPriority); err != nil {
+		return fmt.Errorf("swapon %s: %v", dev, err)
+	}
+	// comp_algorithm lists all algorithms with the selected one in brackets.
+	algo := readSysFile(filepath.Join(sysDev, "comp_algorithm"))
+	if i, j := strings.IndexByte(algo, '['), strings.IndexByte(algo, ']'); i >= 0 && j > i {
+		algo = algo[i+1 : j]
+	}
+	boot.event("memory", "Enabled %d MiB zram swap (%s)", size>>20, algo)
+	return nil
+}
+
+// setupMemory sets up zram swap and swappiness and starts the pressure
+// monitor.
+func setupMemory() {
+	c := loadMemoryConfig()
+	if c.zramSize != "" && c.zramSize != "0" {
+		if err := c.setupZram(); err != nil {
+			boot.fail("memory", err)
+		}
+	}
+	if c.swappiness != "" {
+		if err := writeSysctl(sysctlPath("vm.swappiness"), c.swappiness); err != nil {
+			boot.fail("memory", fmt.Errorf("setting swappiness: %v", err))
+		}
+	}
+	if c.pressureKind != "" {
+		go func() {
+			if err := c.monitorPressure(); err != nil {
+				boot.fail("memory", fmt.Errorf("pressure monitor: %v", err))
+			}
+		}()
+	}
+}
+
+// pressureFile returns the memory PSI file of the root cgroup, falling back
+// to the system wide one.
+func pressureFile() string {
+	if _, err := os.Stat("/sys/fs/cgroup/memory.pressure"); err == nil {
+		return "/sys/fs/cgroup/memory.pressure"
+	}
+	return "/proc/pressure/memory"
+}
+
+// readPressure returns the fields of the "some" or "full" line of a PSI
+// file, e.g. avg10.
+func readPressure(path, kind string) map[string]string {
+	lines, _ := readConfLines(path)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != kind {
+			continue
+		}
+		m := map[string]string{}
+		for _, f := range fields[1:] {
+			if kv := strings.SplitN(f, "=", 2); len(kv) == 2 {
+				m[strings.ToUpper(kv[0])] = kv[1]
+			}
+		}
+		return m
+	}
+	return nil
+}
+
+func (c *memoryConfig) runPressureActions() {
+	for _, a := range c.pressureActions {
+		switch {
+		case a == "drop-caches":
+			syscall.Sync()
+			if err := writeSysctl(sysctlPath("vm.drop_caches"), "3"); err != nil {
+				logger.Printf("Error dropping caches: %v", err)
+				continue
+			}
+			logger.Println("Dropped caches")
+		case strings.HasPrefix(a, "restart:"):
+			name := strings.TrimPrefix(a, "restart:")
+			svc := services.lookup(name)
+			if svc == nil {
+				logger.Printf("Cannot restart unknown service %q", name)
+				continue
+			}
+			if err := svc.restart(); err != nil {
+				logger.Printf("Error restarting %s: %v", name, err)
+			}
+		}
+	}
+}
+
+// monitorPressure registers a PSI trigger and acts on each sustained
+// memory pressure event, at most once per cooldown.
+func (c *memoryConfig) monitorPressure() error {
+	path := pressureFile()
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	trigger := fmt.Sprintf("%s %d %d", c.pressureKind, c.pressureStall.Microseconds(), c.pressureWindow.Microseconds())
+	if _, err := unix.Write(fd, append([]byte(trigger), 0)); err != nil {
+		return fmt.Errorf("registering trigger %q on %s: %v", trigger, path, err)
+	}
+	logger.Printf("Monitoring memory pressure on %s: %s", path, trigger)
+
+	var last time.Time
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLPRI}}
+	for {
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return err
+		}
+		if fds[0].Revents&unix.POLLERR != 0 {
+			return errors.New("trigger removed")
+		}
+		if fds[0].Revents&unix.POLLPRI == 0 {
+			continue
+		}
+		data := readPressure(path, c.pressureKind)
+		logger.Printf("Memory pressure (%s): avg10=%s avg60=%s", c.pressureKind, data["AVG10"], data["AVG60"])
+		events.publish("memory/pressure", data)
+		if time.Since(last) >= c.pressureCooldown {
+			last = time.Now()
+			c.runPressureActions()
+		}
+	}
+}
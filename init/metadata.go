@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	metadataURL = "http://169.254.169.254/computeMetadata/v1/"
+	defaultEtag = "NONE"
+)
+
+var (
+	metadataClient = &http.Client{Timeout: 5 * time.Second}
+	// metadataWatchClient outlasts the timeout_sec of watch requests.
+	metadataWatchClient = &http.Client{Timeout: 130 * time.Second}
+)
+
+func fetchMetadata(client *http.Client, path string) (string, string, error) {
+	req, err := http.NewRequest("GET", metadataURL+path, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", "", fmt.Errorf("metadata %s: %w", path, os.ErrNotExist)
+	default:
+		return "", "", fmt.Errorf("metadata %s: %s", path, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	etag := resp.Header.Get("etag")
+	if etag == "" {
+		etag = defaultEtag
+	}
+	return string(b), etag, nil
+}
+
+// getMetadata fetches path from the metadata server. A missing key is
+// reported as os.ErrNotExist.
+func getMetadata(path string) (string, error) {
+	v, _, err := fetchMetadata(metadataClient, path)
+	return v, err
+}
+
+// watchMetadata waits until the value of path no longer has the given etag
+// and returns the new value and etag. Use defaultEtag to return at once.
+func watchMetadata(path, etag string) (string, string, error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	for {
+		v, newEtag, err := fetchMetadata(metadataWatchClient, path+sep+"wait_for_change=true&timeout_sec=120&last_etag="+etag)
+		if err != nil || newEtag != etag {
+			return v, newEtag, err
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	modulesLoadDirs = []string{"/etc/modules-load.d", "/var/lib/ecl/modules-load.d"}
+	modprobeDirs    = []string{"/etc/modprobe.d", "/var/lib/ecl/modprobe.d"}
+	modulesRoot     = "/lib/modules"
+)
+
+// moduleLoader loads kernel modules and their dependencies as listed in
+// modules.dep. Modules must be stored uncompressed.
+type moduleLoader struct {
+	dir       string
+	paths     map[string]string
+	deps      map[string][]string
+	builtin   map[string]bool
+	loaded    map[string]bool
+	options   map[string]string
+	blacklist map[string]bool
+}
+
+// moduleName turns a module path or name into the name the kernel uses.
+func moduleName(s string) string {
+	s = filepath.Base(s)
+	if i := strings.Index(s, ".ko"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.Replace(s, "-", "_", -1)
+}
+
+// readConfLines returns the non empty lines of file with comments removed.
+func readConfLines(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func newModuleLoader(release string) (*moduleLoader, error) {
+	m := &moduleLoader{
+		dir:       filepath.Join(modulesRoot, release),
+		paths:     map[string]string{},
+		deps:      map[string][]string{},
+		builtin:   map[string]bool{},
+		loaded:    map[string]bool{},
+		options:   map[string]string{},
+		blacklist: map[string]bool{},
+	}
+
+	lines, err := readConfLines(filepath.Join(m.dir, "modules.dep"))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		parts := strings.SplitN(line, ":", 2)
+		name := moduleName(parts[0])
+		m.paths[name] = parts[0]
+		if len(parts) == 2 {
+			for _, dep := range strings.Fields(parts[1]) {
+				m.deps[name] = append(m.deps[name], moduleName(dep))
+			}
+		}
+	}
+
+	if lines, err := readConfLines(filepath.Join(m.dir, "modules.builtin")); err == nil {
+		for _, line := range lines {
+			m.builtin[moduleName(line)] = true
+		}
+	}
+
+	if lines, err := readConfLines("/proc/modules"); err == nil {
+		for _, line := range lines {
+			m.loaded[strings.Fields(line)[0]] = true
+		}
+	}
+
+	for _, file := range confFiles(modprobeDirs, ".conf") {
+		lines, err := readConfLines(file)
+		if err != nil {
+			logger.Printf("Error reading %s: %v", file, err)
+			continue
+		}
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			switch {
+			case fields[0] == "blacklist" && len(fields) == 2:
+				m.blacklist[moduleName(fields[1])] = true
+			case fields[0] == "options" && len(fields) > 2:
+				name := moduleName(fields[1])
+				m.options[name] = strings.TrimSpace(m.options[name] + " " + strings.Join(fields[2:], " "))
+			}
+		}
+	}
+	return m, nil
+}
+
+func (m *moduleLoader) load(name string) error {
+	name = moduleName(name)
+	if m.builtin[name] || m.loaded[name] {
+		return nil
+	}
+	path, ok := m.paths[name]
+	if !ok {
+		return fmt.Errorf("module %s not found in %s", name, m.dir)
+	}
+
+	deps := m.deps[name]
+	for i := len(deps) - 1; i >= 0; i-- {
+		if err := m.load(deps[i]); err != nil {
+			return fmt.Errorf("dependency of %s: %v", name, err)
+		}
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(m.dir, path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := unix.FinitModule(int(f.Fd()), m.options[name], 0); err != nil && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("loading %s: %v", name, err)
+	}
+	m.loaded[name] = true
+	return nil
+}
+
+// loadModules loads the modules listed in modulesLoadDirs.
+func loadModules() {
+	var modules []string
+	for _, file := range confFiles(modulesLoadDirs, ".conf") {
+		lines, err := readConfLines(file)
+		if err != nil {
+			boot.fail("modules", err)
+			continue
+		}
+		modules = append(modules, lines...)
+	}
+	if len(modules) == 0 {
+		return
+	}
+
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		boot.fail("modules", err)
+		return
+	}
+	m, err := newModuleLoader(unix.ByteSliceToString(uts.Release[:]))
+	if err != nil {
+		boot.fail("modules", err)
+		return
+	}
+
+	for _, name := range modules {
+		if m.blacklist[moduleName(name)] {
+			logger.Printf("Not loading blacklisted module %s", name)
+			continue
+		}
+		if err := m.load(name); err != nil {
+			boot.fail("modules", err)
+			continue
+		}
+		logger.Printf("Loaded module %s", name)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// timesyncDirs hold *.conf files listing one NTP server per line,
+	// host or host:port. Without any the metadata server is used.
+	timesyncDirs   = []string{"/etc/timesync.d", "/var/lib/ecl/timesync.d"}
+	defaultServers = []string{metadataAddress}
+	rtcDevice      = "/dev/rtc0"
+	// ntpTimeout is how long a server has to reply.
+	ntpTimeout = 5 * time.Second
+)
+
+const (
+	ntpPort = "123"
+	// ntpEpochOffset is the number of seconds from 1900 to 1970.
+	ntpEpochOffset = 2208988800
+
+	// Offsets above stepThreshold are corrected by stepping the clock,
+	// smaller ones are slewed.
+	stepThreshold = 128 * time.Millisecond
+	minPoll       = 64 * time.Second
+	maxPoll       = 1024 * time.Second
+	// rtcInterval matches the kernel's 11 minute mode.
+	rtcInterval = 11 * time.Minute
+
+	adjOffsetSingleshot = 0x8001
+	adjMaxError         = 0x0004
+	adjEstError         = 0x0008
+	adjStatus           = 0x0010
+	staUnsync           = 0x0040
+)
+
+type ntpResult struct {
+	Server string
+	Offset time.Duration
+	Delay  time.Duration
+}
+
+type timeStatus struct {
+	Synced   bool
+	Server   string        `json:",omitempty"`
+	Offset   time.Duration `json:",omitempty"`
+	Delay    time.Duration `json:",omitempty"`
+	LastSync time.Time     `json:",omitempty"`
+	Error    string        `json:",omitempty"`
+}
+
+// timeSync is the state of the SNTP client, served on the control interface.
+type timeSync struct {
+	mu     sync.Mutex
+	status timeStatus
+}
+
+var timesync = &timeSync{}
+
+func (t *timeSync) get() timeStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+func toNTPTime(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return secs<<32 | frac
+}
+
+func fromNTPTime(v uint64) time.Time {
+	secs := int64(v>>32) - ntpEpochOffset
+	nsec := int64((v & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(secs, nsec)
+}
+
+// clockOffset returns the offset of the server's clock and the round trip
+// delay from the times the request was sent (t1) and received (t2) and the
+// reply sent (t3) and received (t4).
+func clockOffset(t1, t2, t3, t4 time.Time) (offset, delay time.Duration) {
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, t4.Sub(t1) - t3.Sub(t2)
+}
+
+// stepClock reports whether offset is corrected by stepping the clock
+// rather than slewing it.
+func stepClock(offset time.Duration) bool {
+	return offset > stepThreshold || offset < -stepThreshold
+}
+
+// queryNTP sends a single SNTP request to server.
+func queryNTP(server string) (*ntpResult, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, ntpPort)
+	}
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ntpTimeout))
+
+	req := make([]byte, 48)
+	req[0] = 4<<3 | 3 // version 4, client
+	t1 := time.Now()
+	// The transmit timestamp comes back as the originate timestamp and
+	// identifies the reply.
+	xmit := toNTPTime(t1)
+	binary.BigEndian.PutUint64(req[40:], xmit)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, 48)
+	for {
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 48 && binary.BigEndian.Uint64(resp[24:]) == xmit {
+			break
+		}
+	}
+	t4 := time.Now()
+
+	switch {
+	case resp[0]&7 != 4:
+		return nil, errors.New("reply is not in server mode")
+	case resp[0]>>6 == 3:
+		return nil, errors.New("server clock not synchronized")
+	case resp[1] == 0:
+		return nil, fmt.Errorf("kiss of death %q", resp[12:16])
+	case resp[1] > 15:
+		return nil, fmt.Errorf("bad stratum %d", resp[1])
+	}
+	t2 := fromNTPTime(binary.BigEndian.Uint64(resp[32:]))
+	t3 := fromNTPTime(binary.BigEndian.Uint64(resp[40:]))
+	offset, delay := clockOffset(t1, t2, t3, t4)
+	return &ntpResult{Server: server, Offset: offset, Delay: delay}, nil
+}
+
+func loadTimeServers() []string {
+	var servers []string
+	for _, file := range confFiles(timesyncDirs, ".conf") {
+		lines, err := readConfLines(file)
+		if err != nil {
+			boot.fail("timesync", err)
+			continue
+		}
+		servers = append(servers, lines...)
+	}
+	if len(servers) == 0 {
+		return defaultServers
+	}
+	return servers
+}
+
+// adjustClock corrects the system clock by offset and marks it synchronized
+// so the kernel reports it as such.
+func adjustClock(offset, maxError time.Duration) error {
+	if stepClock(offset) {
+		tv := unix.NsecToTimeval(time.Now().Add(offset).UnixNano())
+		if err := unix.Settimeofday(&tv); err != nil {
+			return fmt.Errorf("stepping clock: %v", err)
+		}
+		logger.Printf("Stepped clock by %s", offset)
+	} else {
+		tx := unix.Timex{Modes: adjOffsetSingleshot, Offset: offset.Microseconds()}
+		if _, err := unix.Adjtimex(&tx); err != nil {
+			return fmt.Errorf("slewing clock: %v", err)
+		}
+	}
+
+	var tx unix.Timex
+	if _, err := unix.Adjtimex(&tx); err != nil {
+		return err
+	}
+	tx = unix.Timex{
+		Modes:    adjStatus | adjMaxError | adjEstError,
+		Status:   tx.Status &^ staUnsync,
+		Maxerror: maxError.Microseconds(),
+		Esterror: maxError.Microseconds(),
+	}
+	_, err := unix.Adjtimex(&tx)
+	return err
+}
+
+// writeRTC sets the hardware clock, kept in UTC, to the system time.
+func writeRTC() error {
+	fd, err := unix.Open(rtcDevice, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	now := time.Now().UTC()
+	return unix.IoctlSetRTCTime(fd, &unix.RTCTime{
+		Sec:  int32(now.Second()),
+		Min:  int32(now.Minute()),
+		Hour: int32(now.Hour()),
+		Mday: int32(now.Day()),
+		Mon:  int32(now.Month()) - 1,
+		Year: int32(now.Year()) - 1900,
+	})
+}
+
+// sync queries the servers and corrects the clock from the reply with the
+// lowest delay.
+func (t *timeSync) sync(servers []string) error {
+	var best *ntpResult
+	var errs []string
+	for _, s := range servers {
+		r, err := queryNTP(s)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", s, err))
+			continue
+		}
+		if best == nil || r.Delay < best.Delay {
+			best = r
+		}
+	}
+	if best == nil {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	if err := adjustClock(best.Offset, best.Delay/2); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	first := !t.status.Synced
+	t.status = timeStatus{Synced: true, Server: best.Server, Offset: best.Offset, Delay: best.Delay, LastSync: time.Now()}
+	t.mu.Unlock()
+	if first {
+		boot.event("timesync", "Synchronized with %s, offset %s", best.Server, best.Offset)
+		events.publish("time/synced", map[string]string{"SERVER": best.Server, "OFFSET": best.Offset.String()})
+		reachTarget("time-synced")
+	}
+	return nil
+}
+
+// runTimesync keeps the system clock synchronized, polling more often while
+// the offset is large or the servers do not answer.
+func runTimesync() {
+	servers := loadTimeServers()
+	poll := minPoll
+	var lastRTC time.Time
+	for {
+		if err := timesync.sync(servers); err != nil {
+			logger.Printf("Time synchronization failed: %v", err)
+			timesync.mu.Lock()
+			timesync.status.Error = err.Error()
+			timesync.mu.Unlock()
+			poll = minPoll
+		} else {
+			if st := timesync.get(); st.Offset < stepThreshold/4 && st.Offset > -stepThreshold/4 && poll < maxPoll {
+				poll *= 2
+			}
+			if time.Since(lastRTC) >= rtcInterval {
+				if err := writeRTC(); err != nil && !os.IsNotExist(err) {
+					logger.Printf("Error writing %s: %v", rtcDevice, err)
+				}
+				lastRTC = time.Now()
+			}
+		}
+		time.Sleep(poll)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ntpResponder answers SNTP requests on a loopback port, reply edits the
+// server mode reply to each request.
+func ntpResponder(t *testing.T, skew time.Duration, reply func(req, resp []byte)) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 48)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 48 {
+				continue
+			}
+			recv := time.Now().Add(skew)
+			resp := make([]byte, 48)
+			resp[0] = 4<<3 | 4 // version 4, server
+			resp[1] = 2
+			copy(resp[24:32], buf[40:48])
+			binary.BigEndian.PutUint64(resp[32:], toNTPTime(recv))
+			binary.BigEndian.PutUint64(resp[40:], toNTPTime(time.Now().Add(skew)))
+			if reply != nil {
+				reply(buf, resp)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestClockOffset(t *testing.T) {
+	t1 := time.Unix(1000, 0)
+	// 20ms each way, the server is 5s ahead and takes 1ms to answer.
+	t2 := t1.Add(20*time.Millisecond + 5*time.Second)
+	t3 := t2.Add(time.Millisecond)
+	t4 := t1.Add(41 * time.Millisecond)
+	offset, delay := clockOffset(t1, t2, t3, t4)
+	if offset != 5*time.Second {
+		t.Errorf("offset = %s, want 5s", offset)
+	}
+	if delay != 40*time.Millisecond {
+		t.Errorf("delay = %s, want 40ms", delay)
+	}
+}
+
+func TestStepClock(t *testing.T) {
+	for _, tc := range []struct {
+		offset time.Duration
+		step   bool
+	}{
+		{0, false},
+		{stepThreshold, false},
+		{-stepThreshold, false},
+		{stepThreshold + time.Microsecond, true},
+		{-stepThreshold - time.Microsecond, true},
+		{time.Hour, true},
+	} {
+		if got := stepClock(tc.offset); got != tc.step {
+			t.Errorf("stepClock(%s) = %v, want %v", tc.offset, got, tc.step)
+		}
+	}
+}
+
+func TestQueryNTP(t *testing.T) {
+	server := ntpResponder(t, 3*time.Second, nil)
+	r, err := queryNTP(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := r.Offset - 3*time.Second; d > 50*time.Millisecond || d < -50*time.Millisecond {
+		t.Errorf("offset = %s, want about 3s", r.Offset)
+	}
+	if r.Delay < 0 || r.Delay > 50*time.Millisecond {
+		t.Errorf("delay = %s, want a small positive delay", r.Delay)
+	}
+	if r.Server != server {
+		t.Errorf("server = %q, want %q", r.Server, server)
+	}
+}
+
+func TestQueryNTPRejects(t *testing.T) {
+	defer func(d time.Duration) { ntpTimeout = d }(ntpTimeout)
+	ntpTimeout = 200 * time.Millisecond
+
+	for _, tc := range []struct {
+		name  string
+		reply func(req, resp []byte)
+		err   string
+	}{
+		{
+			name:  "client mode",
+			reply: func(req, resp []byte) { resp[0] = 4<<3 | 3 },
+			err:   "not in server mode",
+		},
+		{
+			name:  "unsynchronized",
+			reply: func(req, resp []byte) { resp[0] |= 3 << 6 },
+			err:   "not synchronized",
+		},
+		{
+			name: "kiss of death",
+			reply: func(req, resp []byte) {
+				resp[1] = 0
+				copy(resp[12:16], "RATE")
+			},
+			err: `kiss of death "RATE"`,
+		},
+		{
+			name:  "bad stratum",
+			reply: func(req, resp []byte) { resp[1] = 16 },
+			err:   "bad stratum",
+		},
+		{
+			// A reply to another request is ignored until the deadline.
+			name:  "origin mismatch",
+			reply: func(req, resp []byte) { resp[31]++ },
+			err:   "timeout",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := queryNTP(ntpResponder(t, 0, tc.reply))
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("queryNTP error = %v, want one containing %q", err, tc.err)
+			}
+		})
+	}
+}
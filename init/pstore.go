@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// pstore keeps kernel logs of a crash, and with ramoops the console and
+// /dev/pmsg0, across a reboot. The image reserves memory for ramoops on the
+// kernel command line, see build/daisy-build-image.sh.
+var (
+	pstoreRoot   = "/sys/fs/pstore"
+	pstoreLogDir = "/var/log/pstore"
+	pmsgDevice   = "/dev/pmsg0"
+	// lastBootIDFile names the boot the records in pstore belong to.
+	lastBootIDFile = "/var/lib/ecl/last-boot-id"
+)
+
+var pmsg struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func currentBootID() string {
+	return readSysFile("/proc/sys/kernel/random/boot_id")
+}
+
+// collectPstore moves the records left by the previous boot to
+// pstoreLogDir/<boot-id> and removes them from pstore, which frees them in
+// the backend.
+func collectPstore() error {
+	if !isMounted(pstoreRoot) {
+		if err := os.MkdirAll(pstoreRoot, 0755); err != nil {
+			return err
+		}
+		mount("pstore", pstoreRoot, "pstore", nodev|nosuid|noexec, "")
+	}
+
+	bootID := readSysFile(lastBootIDFile)
+	if bootID == "" {
+		bootID = "unknown"
+	}
+	if err := ioutil.WriteFile(lastBootIDFile, []byte(currentBootID()+"\n"), 0644); err != nil {
+		logger.Printf("Error writing %s: %v", lastBootIDFile, err)
+	}
+
+	entries, err := ioutil.ReadDir(pstoreRoot)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	dir := filepath.Join(pstoreLogDir, bootID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	var dmesg []string
+	for _, e := range entries {
+		src := filepath.Join(pstoreRoot, e.Name())
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			logger.Printf("Error reading %s: %v", src, err)
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, e.Name()), b, 0600); err != nil {
+			return err
+		}
+		if err := os.Remove(src); err != nil {
+			logger.Printf("Error clearing %s: %v", src, err)
+		}
+		// ramoops leaves console-ramoops-0 and pmsg-ramoops-0, the kernel
+		// console and init's log lines, on every reboot. The kernel writes
+		// dmesg records on panics and oopses only.
+		if strings.HasPrefix(e.Name(), "dmesg-") {
+			dmesg = append(dmesg, e.Name())
+		}
+	}
+
+	if len(dmesg) > 0 {
+		boot.event("pstore", "Previous boot %s crashed, %d records saved to %s", bootID, len(entries), dir)
+		events.publish("boot/crashed", map[string]string{"BOOT_ID": bootID, "DIR": dir, "RECORDS": strings.Join(dmesg, ",")})
+	} else {
+		boot.event("pstore", "Saved %d records of boot %s to %s", len(entries), bootID, dir)
+	}
+	return nil
+}
+
+// openPmsg starts copying init's own log lines to the pstore message
+// device, so the last ones survive a panic.
+func openPmsg() {
+	f, err := os.OpenFile(pmsgDevice, os.O_WRONLY, 0)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Printf("Error opening %s: %v", pmsgDevice, err)
+		}
+		return
+	}
+	pmsg.mu.Lock()
+	pmsg.f = f
+	pmsg.mu.Unlock()
+}
+
+func writePmsg(msg string) {
+	pmsg.mu.Lock()
+	defer pmsg.mu.Unlock()
+	if pmsg.f != nil {
+		pmsg.f.WriteString(msg)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioprioClassShift = 13
+	ioprioWhoProcess = 1
+)
+
+var rlimitDirectives = map[string]int{
+	"LIMIT_NOFILE":  unix.RLIMIT_NOFILE,
+	"LIMIT_NPROC":   unix.RLIMIT_NPROC,
+	"LIMIT_CORE":    unix.RLIMIT_CORE,
+	"LIMIT_MEMLOCK": unix.RLIMIT_MEMLOCK,
+}
+
+var ioprioClasses = map[string]int{
+	"rt":          1,
+	"realtime":    1,
+	"be":          2,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+type rlimit struct {
+	Resource int
+	Cur, Max uint64
+}
+
+// resourceConfig holds the scheduling and resource settings of a service.
+type resourceConfig struct {
+	Rlimits     []rlimit
+	OOMScoreAdj *int
+	Nice        *int
+	IOPrio      *int
+	CPUAffinity []int
+}
+
+func (r *resourceConfig) isSet() bool {
+	return len(r.Rlimits) > 0 || r.OOMScoreAdj != nil || r.Nice != nil || r.IOPrio != nil || len(r.CPUAffinity) > 0
+}
+
+func parseLimitValue(v string) (uint64, error) {
+	if v == "infinity" || v == "unlimited" {
+		return math.MaxUint64, nil
+	}
+	return strconv.ParseUint(v, 10, 64)
+}
+
+// parseRlimit accepts "value" for both limits or "soft:hard".
+func parseRlimit(resource int, value string) (rlimit, error) {
+	parts := strings.SplitN(value, ":", 2)
+	cur, err := parseLimitValue(parts[0])
+	if err != nil {
+		return rlimit{}, err
+	}
+	max := cur
+	if len(parts) == 2 {
+		if max, err = parseLimitValue(parts[1]); err != nil {
+			return rlimit{}, err
+		}
+	}
+	if cur > max {
+		return rlimit{}, fmt.Errorf("soft limit %d above hard limit %d", cur, max)
+	}
+	return rlimit{Resource: resource, Cur: cur, Max: max}, nil
+}
+
+// parseIOPrio accepts "class" or "class:level", e.g. "be:4" or "idle".
+func parseIOPrio(value string) (int, error) {
+	parts := strings.SplitN(value, ":", 2)
+	class, ok := ioprioClasses[strings.ToLower(parts[0])]
+	if !ok {
+		return 0, fmt.Errorf("unknown class %q", parts[0])
+	}
+	level := 4
+	if len(parts) == 2 {
+		var err error
+		if level, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, err
+		}
+		if level < 0 || level > 7 {
+			return 0, fmt.Errorf("level %d out of range 0-7", level)
+		}
+	}
+	if class == ioprioClasses["idle"] {
+		level = 0
+	}
+	return class<<ioprioClassShift | level, nil
+}
+
+// parseCPUList accepts a list of CPUs and ranges, e.g. "0-3,6".
+func parseCPUList(value string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		r := strings.SplitN(part, "-", 2)
+		lo, err := strconv.Atoi(r[0])
+		if err != nil {
+			return nil, err
+		}
+		hi := lo
+		if len(r) == 2 {
+			if hi, err = strconv.Atoi(r[1]); err != nil {
+				return nil, err
+			}
+		}
+		if lo < 0 || hi < lo {
+			return nil, fmt.Errorf("bad range %q", part)
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// parseDirective handles the resource directives of a service file. It
+// returns false if key is not one of them.
+func (r *resourceConfig) parseDirective(key, value string) (bool, error) {
+	var err error
+	if resource, ok := rlimitDirectives[key]; ok {
+		var l rlimit
+		if l, err = parseRlimit(resource, value); err == nil {
+			r.Rlimits = append(r.Rlimits, l)
+		}
+	} else {
+		switch key {
+		case "OOM_SCORE_ADJ":
+			var v int
+			if v, err = strconv.Atoi(value); err == nil && (v < -1000 || v > 1000) {
+				err = fmt.Errorf("%d out of range -1000-1000", v)
+			}
+			r.OOMScoreAdj = &v
+		case "NICE":
+			var v int
+			if v, err = strconv.Atoi(value); err == nil && (v < -20 || v > 19) {
+				err = fmt.Errorf("%d out of range -20-19", v)
+			}
+			r.Nice = &v
+		case "IOPRIO":
+			var v int
+			v, err = parseIOPrio(value)
+			r.IOPrio = &v
+		case "CPU_AFFINITY":
+			r.CPUAffinity, err = parseCPUList(value)
+		default:
+			return false, nil
+		}
+	}
+	if err != nil {
+		return true, fmt.Errorf("bad %s: %v", key, err)
+	}
+	return true, nil
+}
+
+// apply sets the resources on the calling process, it has to run before
+// privileges are dropped.
+func (r *resourceConfig) apply() error {
+	for _, l := range r.Rlimits {
+		if err := unix.Setrlimit(l.Resource, &unix.Rlimit{Cur: l.Cur, Max: l.Max}); err != nil {
+			return fmt.Errorf("setting rlimit %d: %v", l.Resource, err)
+		}
+	}
+	if r.OOMScoreAdj != nil {
+		if err := ioutil.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(*r.OOMScoreAdj)), 0644); err != nil {
+			return fmt.Errorf("setting oom_score_adj: %v", err)
+		}
+	}
+	if r.Nice != nil {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, 0, *r.Nice); err != nil {
+			return fmt.Errorf("setting nice: %v", err)
+		}
+	}
+	if r.IOPrio != nil {
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(*r.IOPrio)); errno != 0 {
+			return fmt.Errorf("setting ioprio: %v", errno)
+		}
+	}
+	if len(r.CPUAffinity) > 0 {
+		var set unix.CPUSet
+		for _, cpu := range r.CPUAffinity {
+			set.Set(cpu)
+		}
+		if err := unix.SchedSetaffinity(0, &set); err != nil {
+			return fmt.Errorf("setting cpu affinity: %v", err)
+		}
+	}
+	return nil
+}
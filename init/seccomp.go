@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+
+	// Offsets into struct seccomp_data.
+	seccompDataNr   = 0
+	seccompDataArch = 4
+
+	// Syscalls with this bit set use the x32 ABI and are never matched.
+	syscallX32Bit = 0x40000000
+)
+
+func bpfStmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// compileSeccomp builds a filter that allows only the syscalls in allow, or
+// if allow is empty, denies the syscalls in deny. Denied syscalls fail with
+// EPERM, a foreign architecture kills the process.
+func compileSeccomp(allow, deny []string) ([]unix.SockFilter, error) {
+	if seccompArch == 0 {
+		return nil, errors.New("seccomp is not supported on this architecture")
+	}
+	if len(allow) > 0 && len(deny) > 0 {
+		return nil, errors.New("SECCOMP_ALLOW and SECCOMP_DENY are mutually exclusive")
+	}
+
+	list, match, def := deny, uint32(seccompRetErrno|uint32(unix.EPERM)), uint32(seccompRetAllow)
+	if len(allow) > 0 {
+		list, match, def = allow, seccompRetAllow, seccompRetErrno|uint32(unix.EPERM)
+	}
+
+	prog := []unix.SockFilter{
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, seccompArch, 1, 0),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, seccompRetKillProcess),
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr),
+		bpfJump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, syscallX32Bit, 0, 1),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, seccompRetErrno|uint32(unix.EPERM)),
+	}
+	for _, name := range list {
+		nr, ok := syscallNumbers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown syscall %q", name)
+		}
+		prog = append(prog,
+			bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nr, 0, 1),
+			bpfStmt(unix.BPF_RET|unix.BPF_K, match),
+		)
+	}
+	prog = append(prog, bpfStmt(unix.BPF_RET|unix.BPF_K, def))
+	return prog, nil
+}
+
+func installSeccomp(prog []unix.SockFilter) error {
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	return unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&fprog)), 0, 0)
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	serviceSimple  = "simple"
+	serviceOneshot = "oneshot"
+	serviceTimer   = "timer"
+
+	// historySize is the number of runs kept per service.
+	historySize = 10
+	// stopTimeout is how long a service has to exit after SIGTERM.
+	stopTimeout = 10 * time.Second
+)
+
+// svcDirs are read in order, a file in a later directory replaces the file
+// of the same name in an earlier one. A <file>.d directory in any of them
+// holds drop-ins that are applied after the service file.
+var svcDirs = []string{"/etc/init", "/var/lib/ecl/init.d"}
+
+type runRecord struct {
+	Start    time.Time
+	Duration time.Duration
+	ExitCode int
+	Error    string `json:",omitempty"`
+}
+
+type systemService struct {
+	name, path string
+	args       []string
+	typ        string
+	after      []string
+	interval   time.Duration
+	calendar   *calendarSpec
+	priv       *execConfig
+	// source is the combined content of the service file and its
+	// drop-ins, used to detect changes on reload.
+	source string
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	stopping bool
+	history  []runRecord
+	ready    chan struct{} // closed once dependents may start
+	failed   chan struct{} // closed if a oneshot did not exit 0
+	stopC    chan struct{} // closed when the service is being stopped
+	done     chan struct{} // closed when the service goroutine returns
+}
+
+func parseServiceFile(files ...string) (*systemService, error) {
+	var source bytes.Buffer
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		source.Write(data)
+		source.WriteString("\n")
+	}
+
+	svc := &systemService{typ: serviceSimple, priv: newExecConfig(), source: source.String()}
+	scanner := bufio.NewScanner(&source)
+	var err error
+	for scanner.Scan() {
+		entry := strings.SplitN(scanner.Text(), "=", 2)
+		if len(entry) != 2 {
+			continue
+		}
+		value := strings.Trim(entry[1], `"`)
+		switch entry[0] {
+		case "NAME":
+			svc.name = value
+		case "PATH":
+			svc.path = value
+		case "ARGS":
+			svc.args = strings.Split(strings.Replace(entry[1], " ", "", -1), ",")
+		case "TYPE":
+			svc.typ = value
+		case "AFTER":
+			svc.after = strings.Split(strings.Replace(value, " ", "", -1), ",")
+		case "INTERVAL":
+			if svc.interval, err = time.ParseDuration(value); err != nil {
+				return nil, fmt.Errorf("bad INTERVAL: %v", err)
+			}
+		case "CALENDAR":
+			if svc.calendar, err = parseCalendar(value); err != nil {
+				return nil, fmt.Errorf("bad CALENDAR: %v", err)
+			}
+		default:
+			if _, err := svc.priv.parseDirective(entry[0], value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := svc.priv.validate(); err != nil {
+		return nil, err
+	}
+
+	switch svc.typ {
+	case serviceSimple, serviceOneshot:
+	case serviceTimer:
+		if svc.interval <= 0 && svc.calendar == nil {
+			return nil, errors.New("timer service needs INTERVAL or CALENDAR")
+		}
+	default:
+		return nil, fmt.Errorf("unknown TYPE %q", svc.typ)
+	}
+	return svc, nil
+}
+
+func loadServices(dirs []string) map[string]*systemService {
+	files := map[string]string{}
+	dropIns := map[string][]string{}
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Printf("Error reading service directory %s: %v", dir, err)
+			}
+			continue
+		}
+		for _, e := range entries {
+			path := filepath.Join(dir, e.Name())
+			if !e.IsDir() {
+				files[e.Name()] = path
+				continue
+			}
+			if !strings.HasSuffix(e.Name(), ".d") {
+				continue
+			}
+			name := strings.TrimSuffix(e.Name(), ".d")
+			dropInFiles, err := ioutil.ReadDir(path)
+			if err != nil {
+				logger.Printf("Error reading drop-in directory %s: %v", path, err)
+				continue
+			}
+			for _, f := range dropInFiles {
+				if !f.IsDir() {
+					dropIns[name] = append(dropIns[name], filepath.Join(path, f.Name()))
+				}
+			}
+		}
+	}
+
+	svcs := map[string]*systemService{}
+	for name, file := range files {
+		svc, err := parseServiceFile(append([]string{file}, dropIns[name]...)...)
+		if err != nil {
+			logger.Printf("Error reading service file %s: %v", file, err)
+			continue
+		}
+		svcs[name] = svc
+	}
+	return svcs
+}
+
+func (s *systemService) command() *exec.Cmd {
+	cmd := exec.Command(s.path, s.args...)
+	cmd.Env = []string{"PATH=/usr/sbin:/usr/bin:/sbin:/bin:/usr/local/bin:/usr/local/sbin:/opt/bin"}
+	w := &consoleWriter{name: s.name}
+	cmd.Stdout = w
+	cmd.Stderr = w
+
+	if s.priv.needsHelper() {
+		c := *s.priv
+		c.Path, c.Args, c.Env = cmd.Path, cmd.Args, cmd.Env
+		cfg, _ := json.Marshal(&c)
+		cmd.Path = "/proc/self/exe"
+		cmd.Args = []string{"init", "exec"}
+		cmd.Env = append(cmd.Env, execEnv+"="+string(cfg))
+		cmd.SysProcAttr = c.sysProcAttr()
+	}
+	return cmd
+}
+
+func (s *systemService) record(start time.Time, err error) runRecord {
+	r := runRecord{Start: start, Duration: time.Since(start)}
+	if err != nil {
+		r.ExitCode = -1
+		r.Error = err.Error()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		r.ExitCode = exitErr.ExitCode()
+	}
+
+	s.mu.Lock()
+	s.history = append(s.history, r)
+	if len(s.history) > historySize {
+		s.history = s.history[len(s.history)-historySize:]
+	}
+	s.mu.Unlock()
+	return r
+}
+
+// startCmd starts cmd unless the service is being stopped.
+func (s *systemService) startCmd(cmd *exec.Cmd) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping {
+		return false, nil
+	}
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	s.cmd = cmd
+	return true, nil
+}
+
+// waitCmd waits for cmd to exit and records the result.
+func (s *systemService) waitCmd(cmd *exec.Cmd, start time.Time) runRecord {
+	err := cmd.Wait()
+	s.mu.Lock()
+	s.cmd = nil
+	s.mu.Unlock()
+	return s.record(start, err)
+}
+
+// runOnce runs the service to completion and records the result.
+func (s *systemService) runOnce() (runRecord, bool) {
+	start := time.Now()
+	cmd := s.command()
+	ok, err := s.startCmd(cmd)
+	if err != nil {
+		r := s.record(start, err)
+		logger.Printf("Error starting %s: %v", s.name, err)
+		return r, true
+	}
+	if !ok {
+		return runRecord{}, false
+	}
+	r := s.waitCmd(cmd, start)
+	logger.Printf("%s exited with code %d after %s", s.name, r.ExitCode, r.Duration)
+	return r, true
+}
+
+func (s *systemService) supervise() {
+	for {
+		cmd := s.command()
+		ok, err := s.startCmd(cmd)
+		if err != nil {
+			// Service files can be changed at runtime, don't take
+			// down init over a bad one.
+			logger.Printf("Error starting %s: %v", s.name, err)
+			s.record(time.Now(), err)
+			close(s.failed)
+			return
+		}
+		if !ok {
+			return
+		}
+		s.markReady()
+
+		if r := s.waitCmd(cmd, time.Now()); r.Error != "" {
+			logger.Println(r.Error)
+		}
+	}
+}
+
+func (s *systemService) runTimer() {
+	s.markReady()
+	next := time.Now()
+	for {
+		if s.calendar != nil {
+			var ok bool
+			if next, ok = s.calendar.next(time.Now()); !ok {
+				logger.Printf("%s: CALENDAR never matches, not scheduling", s.name)
+				return
+			}
+		} else {
+			next = next.Add(s.interval)
+			if now := time.Now(); next.Before(now) {
+				next = now
+			}
+		}
+		select {
+		case <-time.After(time.Until(next)):
+		case <-s.stopC:
+			return
+		}
+		if _, ok := s.runOnce(); !ok {
+			return
+		}
+	}
+}
+
+// target is a synchronization point reached by init itself, services list
+// targets in AFTER like services, e.g. AFTER=time-synced.
+type target struct {
+	once    sync.Once
+	reached chan struct{}
+}
+
+var targets = map[string]*target{
+	"time-synced": {reached: make(chan struct{})},
+}
+
+func reachTarget(name string) {
+	t := targets[name]
+	t.once.Do(func() { close(t.reached) })
+}
+
+func (s *systemService) markReady() {
+	select {
+	case <-s.ready:
+	default:
+		close(s.ready)
+	}
+}
+
+// waitFor blocks until all services in after are ready. It returns false if
+// one of them failed or the service is stopped while waiting.
+func (s *systemService) waitFor(sup *supervisor) bool {
+	for _, name := range s.after {
+		dep := sup.lookup(name)
+		if t, ok := targets[name]; ok && dep == nil {
+			select {
+			case <-t.reached:
+				continue
+			case <-s.stopC:
+				return false
+			}
+		}
+		if dep == nil {
+			logger.Printf("%s: unknown dependency %q, ignoring", s.name, name)
+			continue
+		}
+		select {
+		case <-dep.ready:
+		case <-dep.failed:
+			logger.Printf("%s: dependency %q failed, not starting", s.name, name)
+			return false
+		case <-s.stopC:
+			return false
+		}
+	}
+	return true
+}
+
+func (s *systemService) start(sup *supervisor) {
+	defer close(s.done)
+	if !s.waitFor(sup) {
+		close(s.failed)
+		return
+	}
+
+	logger.Println("Starting", s.name)
+	switch s.typ {
+	case serviceOneshot:
+		if r, ok := s.runOnce(); !ok || r.ExitCode != 0 {
+			close(s.failed)
+			return
+		}
+		s.markReady()
+	case serviceTimer:
+		s.runTimer()
+	default:
+		s.supervise()
+	}
+}
+
+// stop terminates the service and waits for its goroutine to return.
+func (s *systemService) stop() {
+	s.mu.Lock()
+	if s.stopping {
+		s.mu.Unlock()
+		<-s.done
+		return
+	}
+	s.stopping = true
+	close(s.stopC)
+	cmd := s.cmd
+	s.mu.Unlock()
+
+	logger.Println("Stopping", s.name)
+	if cmd != nil {
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-s.done:
+			return
+		case <-time.After(stopTimeout):
+			logger.Printf("%s did not exit after %s, killing", s.name, stopTimeout)
+			cmd.Process.Kill()
+		}
+	}
+	<-s.done
+}
+
+// restart makes a simple service exit so that it is started again.
+func (s *systemService) restart() error {
+	s.mu.Lock()
+	cmd := s.cmd
+	s.mu.Unlock()
+	if s.typ != serviceSimple || cmd == nil {
+		return fmt.Errorf("%s is not running", s.name)
+	}
+	logger.Println("Restarting", s.name)
+	return cmd.Process.Signal(syscall.SIGTERM)
+}
+
+// supervisor tracks the running set of services keyed by file name.
+type supervisor struct {
+	applyMu  sync.Mutex // serializes apply
+	mu       sync.Mutex
+	services map[string]*systemService
+}
+
+var services = &supervisor{services: map[string]*systemService{}}
+
+func (sup *supervisor) lookup(name string) *systemService {
+	sup.mu.Lock()
+	defer sup.mu.Unlock()
+	for _, svc := range sup.services {
+		if svc.name == name {
+			return svc
+		}
+	}
+	return nil
+}
+
+// apply makes svcs the running set: new services are started, removed ones
+// stopped and changed ones restarted.
+func (sup *supervisor) apply(svcs map[string]*systemService) {
+	sup.applyMu.Lock()
+	defer sup.applyMu.Unlock()
+
+	sup.mu.Lock()
+	var stop []*systemService
+	var keys []string
+	for k, old := range sup.services {
+		if svc, ok := svcs[k]; ok && svc.source == old.source {
+			continue
+		}
+		stop = append(stop, old)
+		delete(sup.services, k)
+	}
+	for k, svc := range svcs {
+		if _, ok := sup.services[k]; ok {
+			continue
+		}
+		svc.ready = make(chan struct{})
+		svc.failed = make(chan struct{})
+		svc.stopC = make(chan struct{})
+		svc.done = make(chan struct{})
+		sup.services[k] = svc
+		keys = append(keys, k)
+	}
+	sup.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, svc := range stop {
+		wg.Add(1)
+		go func(svc *systemService) {
+			defer wg.Done()
+			svc.stop()
+		}(svc)
+	}
+	wg.Wait()
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		go svcs[k].start(sup)
+	}
+}
+
+func (sup *supervisor) reload() {
+	logger.Println("Reloading service files")
+	sup.apply(loadServices(svcDirs))
+}
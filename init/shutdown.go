@@ -0,0 +1,22 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// shutdown stops all services, saves the state kept across boots and then
+// powers off or reboots as cmd says.
+func shutdown(cmd int) error {
+	logger.Println("Stopping services")
+	services.apply(nil)
+
+	if err := saveRandomSeed(); err != nil {
+		logger.Println("Error saving random seed:", err)
+	}
+
+	logger.Println("Shutting down")
+	logs.Flush(5 * time.Second)
+	syscall.Sync()
+	return syscall.Reboot(cmd)
+}
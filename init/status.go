@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type bootEvent struct {
+	Time      time.Time
+	Component string
+	Message   string
+	Failed    bool `json:",omitempty"`
+}
+
+type bootStatus struct {
+	Start  time.Time
+	Events []bootEvent
+}
+
+// bootReport collects notable events and failures of the boot process, it is
+// served on the control interface.
+type bootReport struct {
+	mu     sync.Mutex
+	events []bootEvent
+}
+
+var boot = &bootReport{}
+
+func (b *bootReport) add(e bootEvent) {
+	e.Time = time.Now()
+	b.mu.Lock()
+	b.events = append(b.events, e)
+	b.mu.Unlock()
+}
+
+// event records and logs a notable boot event.
+func (b *bootReport) event(component, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	logger.Printf("%s: %s", component, msg)
+	b.add(bootEvent{Component: component, Message: msg})
+}
+
+// fail records and logs a failed boot step.
+func (b *bootReport) fail(component string, err error) {
+	logger.Printf("%s: %v", component, err)
+	b.add(bootEvent{Component: component, Message: err.Error(), Failed: true})
+}
+
+func (b *bootReport) status() bootStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bootStatus{Start: start, Events: append([]bootEvent(nil), b.events...)}
+}
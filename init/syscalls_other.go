@@ -0,0 +1,9 @@
+//go:build !amd64
+// +build !amd64
+
+package main
+
+// Seccomp filters are only supported on amd64.
+const seccompArch = 0
+
+var syscallNumbers = map[string]uint32{}
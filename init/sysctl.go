@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	sysctlDirs = []string{"/etc/sysctl.d", "/var/lib/ecl/sysctl.d"}
+	sysctlRoot = "/proc/sys"
+)
+
+type sysctlSetting struct {
+	value     string
+	ignoreErr bool
+	file      string
+}
+
+// sysctlPath converts a key to a path under sysctlRoot. Keys use either dots
+// or slashes as separators, slashes allow dots in interface names.
+func sysctlPath(key string) string {
+	if !strings.Contains(key, "/") {
+		key = strings.Replace(key, ".", "/", -1)
+	}
+	return filepath.Join(sysctlRoot, strings.TrimPrefix(key, "/"))
+}
+
+// readSysctlFile parses a sysctl.d file into settings keyed by path. A key
+// prefixed with "-" does not report failures.
+func readSysctlFile(file string, explicit, globs map[string]sysctlSetting, order *[]string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			logger.Printf("%s:%d: missing '='", file, n)
+			continue
+		}
+		key := strings.TrimSpace(kv[0])
+		s := sysctlSetting{value: strings.TrimSpace(kv[1]), file: file}
+		if strings.HasPrefix(key, "-") {
+			s.ignoreErr = true
+			key = key[1:]
+		}
+
+		path := sysctlPath(key)
+		if strings.ContainsAny(path, "*?[") {
+			globs[path] = s
+		} else {
+			explicit[path] = s
+		}
+		*order = append(*order, path)
+	}
+	return scanner.Err()
+}
+
+// writeSysctl writes value to an existing sysctl file.
+func writeSysctl(path, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(value); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// applySysctl writes the settings from sysctlDirs to /proc/sys. Later files
+// and lines override earlier ones, a key set explicitly always wins over a
+// glob matching it.
+func applySysctl() {
+	explicit := map[string]sysctlSetting{}
+	globs := map[string]sysctlSetting{}
+	var order []string
+	for _, file := range confFiles(sysctlDirs, ".conf") {
+		if err := readSysctlFile(file, explicit, globs, &order); err != nil {
+			boot.fail("sysctl", err)
+		}
+	}
+
+	settings := map[string]sysctlSetting{}
+	for _, pattern := range order {
+		s, ok := globs[pattern]
+		if !ok {
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			boot.fail("sysctl", fmt.Errorf("%s: %v", s.file, err))
+			continue
+		}
+		for _, path := range matches {
+			if _, ok := explicit[path]; !ok {
+				settings[path] = s
+			}
+		}
+	}
+	for path, s := range explicit {
+		settings[path] = s
+	}
+
+	var paths []string
+	for path := range settings {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		s := settings[path]
+		if err := writeSysctl(path, s.value); err != nil {
+			if !s.ignoreErr {
+				boot.fail("sysctl", fmt.Errorf("%s: setting %s: %v", s.file, path, err))
+			}
+			continue
+		}
+		logger.Printf("sysctl: %s = %s", strings.TrimPrefix(path, sysctlRoot+"/"), s.value)
+	}
+}
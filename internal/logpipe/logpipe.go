@@ -0,0 +1,170 @@
+// Package logpipe decouples log writers from a slow console. Writes never
+// block, lines that can not be buffered are counted and reported with a
+// marker once their source gets through again.
+package logpipe
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// RingSize is the number of messages buffered for the console. When
+	// full the oldest message is dropped.
+	RingSize = 1024
+	// Rate and Burst limit how many lines per second a single source can
+	// push into the ring.
+	Rate  = 200
+	Burst = 1000
+)
+
+type entry struct {
+	source string
+	msg    string
+	lines  int
+	// dropped lines of source were rate limited right before msg.
+	dropped int
+}
+
+type source struct {
+	tokens float64
+	last   time.Time
+	// dropped lines were rate limited since the last queued message,
+	// evicted ones were pushed out of the ring and are older than all
+	// those in it.
+	dropped int
+	evicted int
+}
+
+// Pipeline buffers messages in a ring and writes them to out from Run.
+type Pipeline struct {
+	mu      sync.Mutex
+	ring    [RingSize]entry
+	head    int
+	count   int
+	busy    bool
+	sources map[string]*source
+	notify  chan struct{}
+	out     io.Writer
+	marker  func(source string, dropped int) string
+	now     func() time.Time
+}
+
+// New returns a Pipeline writing to out, marker formats the message
+// reporting that dropped lines of source were lost.
+func New(out io.Writer, marker func(source string, dropped int) string) *Pipeline {
+	return &Pipeline{
+		sources: map[string]*source{},
+		notify:  make(chan struct{}, 1),
+		out:     out,
+		marker:  marker,
+		now:     time.Now,
+	}
+}
+
+func (p *Pipeline) source(name string) *source {
+	src, ok := p.sources[name]
+	if !ok {
+		src = &source{tokens: Burst, last: p.now()}
+		p.sources[name] = src
+	}
+	return src
+}
+
+// Write queues msg, made of lines lines, from source.
+func (p *Pipeline) Write(source, msg string, lines int) {
+	p.mu.Lock()
+	src := p.source(source)
+	now := p.now()
+	src.tokens += now.Sub(src.last).Seconds() * Rate
+	if src.tokens > Burst {
+		src.tokens = Burst
+	}
+	src.last = now
+	if src.tokens < float64(lines) {
+		src.dropped += lines
+		p.mu.Unlock()
+		return
+	}
+	src.tokens -= float64(lines)
+
+	if p.count == RingSize {
+		old := p.ring[p.head]
+		p.source(old.source).evicted += old.dropped + old.lines
+		p.head = (p.head + 1) % RingSize
+		p.count--
+	}
+	p.ring[(p.head+p.count)%RingSize] = entry{source: source, msg: msg, lines: lines, dropped: src.dropped}
+	src.dropped = 0
+	p.count++
+	p.mu.Unlock()
+
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next pops the oldest entry, prefixed by a marker for the lines of its
+// source dropped before it. Once the ring is empty any outstanding markers
+// are returned.
+func (p *Pipeline) next() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.count > 0 {
+		e := p.ring[p.head]
+		p.ring[p.head] = entry{}
+		p.head = (p.head + 1) % RingSize
+		p.count--
+		p.busy = true
+		src := p.source(e.source)
+		if n := src.evicted + e.dropped; n > 0 {
+			src.evicted = 0
+			return p.marker(e.source, n) + e.msg, true
+		}
+		return e.msg, true
+	}
+
+	var markers string
+	for name, src := range p.sources {
+		if n := src.evicted + src.dropped; n > 0 {
+			markers += p.marker(name, n)
+			src.evicted, src.dropped = 0, 0
+		}
+	}
+	p.busy = markers != ""
+	return markers, markers != ""
+}
+
+// Run writes the queued messages to out, it never returns.
+func (p *Pipeline) Run() {
+	for range p.notify {
+		for {
+			msg, ok := p.next()
+			if !ok {
+				break
+			}
+			io.WriteString(p.out, msg)
+		}
+	}
+}
+
+// Flush waits up to timeout for all buffered messages to reach out.
+func (p *Pipeline) Flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		p.mu.Lock()
+		done := p.count == 0 && !p.busy
+		p.mu.Unlock()
+		if done {
+			return
+		}
+		select {
+		case p.notify <- struct{}{}:
+		default:
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
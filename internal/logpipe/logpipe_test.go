@@ -0,0 +1,176 @@
+package logpipe
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func marker(source string, n int) string {
+	return fmt.Sprintf("[%s] %d lines dropped\n", source, n)
+}
+
+// fakeClock is a settable time source.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func newTest(out *syncBuffer) (*Pipeline, *fakeClock) {
+	c := &fakeClock{t: time.Unix(1000, 0)}
+	p := New(out, marker)
+	p.now = c.now
+	return p, c
+}
+
+// syncBuffer is a bytes.Buffer safe to read while Run writes to it.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// dropped returns the lines of source dropped so far.
+func dropped(p *Pipeline, source string) int {
+	n := p.sources[source].dropped + p.sources[source].evicted
+	for i := 0; i < p.count; i++ {
+		if e := p.ring[(p.head+i)%RingSize]; e.source == source {
+			n += e.dropped
+		}
+	}
+	return n
+}
+
+// drain returns all the messages next hands out.
+func drain(p *Pipeline) string {
+	var out string
+	for {
+		msg, ok := p.next()
+		if !ok {
+			return out
+		}
+		out += msg
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	p, clock := newTest(&syncBuffer{})
+
+	// A burst is let through, the lines over it are dropped.
+	p.Write("a", "burst\n", Burst)
+	p.Write("a", "over\n", 1)
+	if got := dropped(p, "a"); got != 1 {
+		t.Errorf("dropped = %d, want 1", got)
+	}
+	// Other sources have their own bucket.
+	p.Write("b", "b\n", 1)
+	if got := dropped(p, "b"); got != 0 {
+		t.Errorf("dropped of b = %d, want 0", got)
+	}
+
+	// Tokens come back at Rate per second.
+	clock.t = clock.t.Add(time.Second)
+	p.Write("a", "refilled\n", Rate)
+	p.Write("a", "over again\n", 1)
+	if got := dropped(p, "a"); got != 2 {
+		t.Errorf("dropped = %d, want 2", got)
+	}
+
+	// But never more than Burst.
+	clock.t = clock.t.Add(time.Hour)
+	p.Write("a", "long burst\n", Burst+1)
+	if got := dropped(p, "a"); got != 2+Burst+1 {
+		t.Errorf("dropped = %d, want %d", got, 2+Burst+1)
+	}
+}
+
+func TestDropMarkers(t *testing.T) {
+	p, _ := newTest(&syncBuffer{})
+	p.Write("a", "first\n", Burst)
+	p.Write("a", "lost\n", 3)
+	p.Write("b", "b\n", 1)
+
+	// The marker of a source comes before its next message, outstanding
+	// ones once the ring is empty.
+	if got, want := drain(p), "first\nb\n[a] 3 lines dropped\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	p.Write("a", "lost\n", 2)
+	p.sources["a"].tokens = Burst
+	p.Write("a", "back\n", 1)
+	if got, want := drain(p), "[a] 2 lines dropped\nback\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := drain(p); got != "" {
+		t.Errorf("markers repeated: %q", got)
+	}
+}
+
+func TestRingOverflow(t *testing.T) {
+	p, _ := newTest(&syncBuffer{})
+	// Spread over sources so that no bucket runs out.
+	for i := 0; i < RingSize+5; i++ {
+		p.Write(fmt.Sprintf("s%d", i%10), fmt.Sprintf("%d\n", i), 1)
+	}
+	out := drain(p)
+	if !strings.HasPrefix(out, "5\n6\n7\n8\n9\n[s0] 1 lines dropped\n10\n") {
+		t.Errorf("oldest messages not replaced by a marker: %.80q", out)
+	}
+	dropped := strings.Count(out, "lines dropped")
+	if dropped != 5 {
+		t.Errorf("got %d markers, want 5", dropped)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	out := &syncBuffer{}
+	p, _ := newTest(out)
+	var want string
+	for i := 0; i < 100; i++ {
+		msg := fmt.Sprintf("line %d\n", i)
+		p.Write("a", msg, 1)
+		want += msg
+	}
+	go p.Run()
+	p.Flush(5 * time.Second)
+	if got := out.String(); got != want {
+		t.Errorf("flushed %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestFlushMarkers(t *testing.T) {
+	out := &syncBuffer{}
+	p, _ := newTest(out)
+	p.Write("a", "a\n", Burst)
+	p.Write("a", "lost\n", 7)
+	go p.Run()
+	p.Flush(5 * time.Second)
+	if got, want := out.String(), "a\n[a] 7 lines dropped\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	p, _ := newTest(&syncBuffer{})
+	p.Write("a", "never written\n", 1)
+	start := time.Now()
+	// Nothing runs the pipeline, Flush gives up.
+	p.Flush(50 * time.Millisecond)
+	if d := time.Since(start); d < 50*time.Millisecond || d > 2*time.Second {
+		t.Errorf("Flush returned after %s", d)
+	}
+}
@@ -15,27 +15,36 @@ apt-get install -y \
   flex \
   libelf-dev \
   bc \
-  liblz4-tool
+  liblz4-tool \
+  kmod
 
 KERNEL_VERSION='5.17.6'
 curl -s https://cdn.kernel.org/pub/linux/kernel/v5.x/linux-${KERNEL_VERSION}.tar.xz | tar -Jxf -
 cp linux/.config linux-${KERNEL_VERSION}/.config 
-make -C linux-${KERNEL_VERSION} -j $(nproc) \
-  CC=clang-13 \
-  LD=ld.lld-13 \
-  AR=llvm-ar-13 \
-  NM=llvm-nm-13 \
-  STRIP=llvm-strip-13 \
-  OBJCOPY=llvm-objcopy-13 \
-  OBJDUMP=llvm-objdump-13 \
-  READELF=llvm-readelf-13 \
-  HOSTCC=clang-13 \
-  HOSTCXX=clang++-13 \
-  HOSTAR=llvm-ar-13 \
-  HOSTLD=ld.lld-13
+MAKE_ARGS="
+  CC=clang-13
+  LD=ld.lld-13
+  AR=llvm-ar-13
+  NM=llvm-nm-13
+  STRIP=llvm-strip-13
+  OBJCOPY=llvm-objcopy-13
+  OBJDUMP=llvm-objdump-13
+  READELF=llvm-readelf-13
+  HOSTCC=clang-13
+  HOSTCXX=clang++-13
+  HOSTAR=llvm-ar-13
+  HOSTLD=ld.lld-13"
+make -C linux-${KERNEL_VERSION} $MAKE_ARGS olddefconfig
+make -C linux-${KERNEL_VERSION} -j $(nproc) $MAKE_ARGS
 
 mkdir pkgroot
 cp "linux-${KERNEL_VERSION}/arch/x86_64/boot/bzImage" pkgroot/
+
+# Modules are unpacked onto the root partition like the other packages.
+mkdir -p modroot/p3
+make -C linux-${KERNEL_VERSION} $MAKE_ARGS INSTALL_MOD_PATH=$(pwd)/modroot/p3 INSTALL_MOD_STRIP=1 modules_install
+rm -f modroot/p3/lib/modules/*/build modroot/p3/lib/modules/*/source
   
 mkdir -p /workspace/packages
-tar -czvf /workspace/packages/kernel.tar.gz -C pkgroot .
\ No newline at end of file
+tar -czvf /workspace/packages/kernel.tar.gz -C pkgroot .
+tar -czvf /workspace/packages/modules.tar.gz -C modroot .
\ No newline at end of file
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+)
+
+// controlSocket serves a small HTTP/JSON API, access is limited to root by
+// the socket's permissions.
+var controlSocket = "/run/caaos/caaos.sock"
+
+// containerInfo is a container as listed by the control API.
+type containerInfo struct {
+	containerStatus
+	// Source is "file" for services from /etc/caaos, "metadata" otherwise.
+	Source string
+	Image  string `json:",omitempty"`
+}
+
+type imageInfo struct {
+	Name   string
+	Digest string
+	Size   int64 `json:",omitempty"`
+}
+
+type control struct {
+	ctx     context.Context
+	client  *containerd.Client
+	r       *reconciler
+	watcher *metadataWatcher
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers with err as {"Error": "..."} and a status matching it.
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errUnknownContainer), errdefs.IsNotFound(err):
+		code = http.StatusNotFound
+	case errors.Is(err, errAlreadyRunning), errdefs.IsAlreadyExists(err), errdefs.IsFailedPrecondition(err):
+		code = http.StatusConflict
+	case errdefs.IsInvalidArgument(err):
+		code = http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct{ Error string }{err.Error()})
+}
+
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func (c *control) containers() []containerInfo {
+	var l []containerInfo
+	for _, st := range statuses.list() {
+		info := containerInfo{containerStatus: st, Source: "metadata"}
+		c.r.mu.Lock()
+		if c.r.reserved[st.ID] {
+			info.Source = "file"
+		}
+		if m := c.r.running[st.ID]; m != nil {
+			info.Image = m.svc.Image
+		}
+		c.r.mu.Unlock()
+		l = append(l, info)
+	}
+	return l
+}
+
+func (c *control) container(id string) (containerInfo, error) {
+	for _, info := range c.containers() {
+		if info.ID == id {
+			return info, nil
+		}
+	}
+	return containerInfo{}, errUnknownContainer
+}
+
+// serveLogs writes the logged lines of container id as text, the last tail
+// of them, all by default, and with follow=1 the ones that follow.
+func (c *control) serveLogs(w http.ResponseWriter, r *http.Request, id string) {
+	if _, err := c.container(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	n := -1
+	if v := r.URL.Query().Get("tail"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "bad tail", http.StatusBadRequest)
+			return
+		}
+	}
+	follow, _ := strconv.ParseBool(r.URL.Query().Get("follow"))
+
+	lines, ch, cancel := tails.follow(id, n)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range lines {
+		if _, err := w.Write([]byte(line + "\n")); err != nil {
+			return
+		}
+	}
+	if !follow {
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case line := <-ch:
+			if _, err := w.Write([]byte(line + "\n")); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveContainer handles /v1/containers/<id>[/<action>].
+func (c *control) serveContainer(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1/containers/"), "/", 2)
+	id, action := parts[0], ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+
+	switch action {
+	case "":
+		info, err := c.container(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, info)
+	case "spec":
+		container, err := c.client.LoadContainer(c.ctx, id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		spec, err := container.Spec(c.ctx)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, spec)
+	case "logs":
+		c.serveLogs(w, r, id)
+	case "exec":
+		c.serveExec(w, r, id)
+	case "debug":
+		c.serveDebug(w, r, id)
+	case "start", "stop", "restart":
+		if !requireMethod(w, r, http.MethodPost) {
+			return
+		}
+		var err error
+		switch action {
+		case "start":
+			err = c.r.startContainer(c.ctx, id)
+		case "stop":
+			err = c.r.stopContainer(c.ctx, id)
+		case "restart":
+			err = c.r.restartContainer(c.ctx, id)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		info, _ := c.container(id)
+		writeJSON(w, info)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (c *control) servePull(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		http.Error(w, "missing ref", http.StatusBadRequest)
+		return
+	}
+	logger.Printf("Pulling %q on request", ref)
+	img, err := c.client.Pull(namespaces.WithNamespace(r.Context(), caaosNamespace), ref, containerd.WithPullUnpack)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	size, _ := img.Size(c.ctx)
+	writeJSON(w, imageInfo{Name: img.Name(), Digest: img.Target().Digest.String(), Size: size})
+}
+
+// serveImages lists the images, or with DELETE removes image ref.
+func (c *control) serveImages(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		imgs, err := c.client.ListImages(c.ctx)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		l := []imageInfo{}
+		for _, img := range imgs {
+			size, _ := img.Size(c.ctx)
+			l = append(l, imageInfo{Name: img.Name(), Digest: img.Target().Digest.String(), Size: size})
+		}
+		sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+		writeJSON(w, l)
+	case http.MethodDelete:
+		ref := r.URL.Query().Get("ref")
+		if ref == "" {
+			http.Error(w, "missing ref", http.StatusBadRequest)
+			return
+		}
+		logger.Printf("Removing image %q on request", ref)
+		if err := c.client.ImageService().Delete(c.ctx, ref, images.SynchronousDelete()); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, struct{}{})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveValidate checks a service file, or a JSON list of containers as in
+// the containers attribute, without running anything.
+func (c *control) serveValidate(w http.ResponseWriter, r *http.Request) {
+	if !requireMethod(w, r, http.MethodPost) {
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateServices(data, c.r.fileServices()); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(struct{ Error string }{err.Error()})
+		return
+	}
+	writeJSON(w, struct{}{})
+}
+
+func (c *control) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/containers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.containers())
+	})
+	mux.HandleFunc("/v1/containers/", c.serveContainer)
+	mux.HandleFunc("/v1/images", c.serveImages)
+	mux.HandleFunc("/v1/images/pull", c.servePull)
+	mux.HandleFunc("/v1/validate", c.serveValidate)
+	mux.HandleFunc("/v1/metadata", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.watcher.status())
+	})
+	mux.HandleFunc("/v1/reconcile", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodPost) {
+			return
+		}
+		c.r.reconcileAgain(c.ctx)
+		writeJSON(w, c.containers())
+	})
+	return mux
+}
+
+func runControl(ctx context.Context, client *containerd.Client, r *reconciler, watcher *metadataWatcher) error {
+	if err := os.MkdirAll(filepath.Dir(controlSocket), 0755); err != nil {
+		return err
+	}
+	os.Remove(controlSocket)
+	// The socket must never be reachable by others, not even until the
+	// Chmod below.
+	old := syscall.Umask(0077)
+	l, err := net.Listen("unix", controlSocket)
+	syscall.Umask(old)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(controlSocket, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	c := &control{ctx: ctx, client: client, r: r, watcher: watcher}
+	return http.Serve(l, c.handler())
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// coredumpDir is where the collector in init stores cores, each with a JSON
+// file describing it.
+const coredumpDir = "/var/lib/ecl/coredumps"
+
+// coredump is the part of the collector's metadata caaos uses.
+type coredump struct {
+	Time       time.Time
+	PID        int
+	Signal     int
+	Executable string
+	Namespace  string
+	Container  string
+	Core       string
+}
+
+// containerCoredumps returns the cores dumped by processes of container id
+// since the given time, oldest first.
+func containerCoredumps(id string, since time.Time) []coredump {
+	files, _ := filepath.Glob(filepath.Join(coredumpDir, "*.json"))
+	var cores []coredump
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		var c coredump
+		if err := json.Unmarshal(b, &c); err != nil {
+			continue
+		}
+		if c.Namespace == "caaos" && c.Container == id && !c.Time.Before(since.Truncate(time.Second)) {
+			cores = append(cores, c)
+		}
+	}
+	sort.Slice(cores, func(i, j int) bool { return cores[i].Time.Before(cores[j].Time) })
+	return cores
+}
+
+// logCoredumps reports the cores dumped by container id since start.
+func logCoredumps(id string, start time.Time) {
+	for _, c := range containerCoredumps(id, start) {
+		core := c.Core
+		if core == "" {
+			core = "core dropped by quota"
+		} else {
+			core = filepath.Join(coredumpDir, core)
+		}
+		logger.Printf("Container %q: %s (pid %d) dumped core on signal %d: %s", id, c.Executable, c.PID, c.Signal, core)
+	}
+}
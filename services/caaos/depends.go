@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/identifiers"
+)
+
+const (
+	// conditionStarted is met once the dependency's task has started.
+	conditionStarted = "started"
+	// conditionHealthy is met while the dependency is running and ready.
+	conditionHealthy = "healthy"
+	// conditionCompleted is met once the dependency has exited with code 0
+	// and is not restarted.
+	conditionCompleted = "completed"
+
+	stateWaiting = "waiting"
+)
+
+// dependency is a container that has to meet Condition before the one
+// depending on it is started.
+type dependency struct {
+	ID        string
+	Condition string
+}
+
+func (s *caaosService) validate() error {
+	if len(s.Delay) > 0 {
+		return fmt.Errorf("Delay is no longer supported, use DependsOn")
+	}
+	if err := s.RestartPolicy.validate(); err != nil {
+		return err
+	}
+	if err := s.HealthCheck.validate(); err != nil {
+		return err
+	}
+	for _, d := range s.DependsOn {
+		switch d.Condition {
+		case "", conditionStarted, conditionHealthy, conditionCompleted:
+		default:
+			return fmt.Errorf("unknown condition %q for dependency %q", d.Condition, d.ID)
+		}
+		if d.ID == s.ID {
+			return fmt.Errorf("depends on itself")
+		}
+	}
+	return nil
+}
+
+// checkDependencies makes sure the dependencies of svcs are among them or
+// the IDs in others, and that they do not form a cycle.
+func checkDependencies(svcs []*caaosService, others map[string]bool) error {
+	byID := map[string]*caaosService{}
+	for _, svc := range svcs {
+		byID[svc.ID] = svc
+	}
+	for _, svc := range svcs {
+		for _, d := range svc.DependsOn {
+			if byID[d.ID] == nil && !others[d.ID] {
+				return fmt.Errorf("container %q depends on unknown container %q", svc.ID, d.ID)
+			}
+		}
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	var visit func(id string, path []string) error
+	visit = func(id string, path []string) error {
+		switch state[id] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(append(path, id), " -> "))
+		case done:
+			return nil
+		}
+		state[id] = visiting
+		if svc := byID[id]; svc != nil {
+			for _, d := range svc.DependsOn {
+				if err := visit(d.ID, append(path, id)); err != nil {
+					return err
+				}
+			}
+		}
+		state[id] = done
+		return nil
+	}
+	for _, svc := range svcs {
+		if err := visit(svc.ID, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check reports whether st meets the condition, or an error once it never
+// will.
+func (d dependency) check(st containerStatus) (bool, error) {
+	switch d.Condition {
+	case "", conditionStarted:
+		if !st.StartedAt.IsZero() {
+			return true, nil
+		}
+		if st.State == stateFailed || st.State == stateExited {
+			return false, fmt.Errorf("never started: %s", st.LastError)
+		}
+	case conditionHealthy:
+		if st.State == stateRunning && st.Ready {
+			return true, nil
+		}
+		if st.State == stateFailed || st.State == stateExited {
+			return false, fmt.Errorf("%s with code %d", st.State, st.LastExitCode)
+		}
+	case conditionCompleted:
+		if st.State == stateExited {
+			return true, nil
+		}
+		if st.State == stateFailed {
+			if st.LastError != "" {
+				return false, fmt.Errorf("failed: %s", st.LastError)
+			}
+			return false, fmt.Errorf("failed with code %d", st.LastExitCode)
+		}
+	}
+	return false, nil
+}
+
+// waitDependencies blocks until all dependencies of s meet their condition.
+func (s *caaosService) waitDependencies(ctx context.Context) error {
+	for _, d := range s.DependsOn {
+		cond := d.Condition
+		if cond == "" {
+			cond = conditionStarted
+		}
+		logged := false
+		for {
+			changed := statuses.changed()
+			st, found := statuses.get(d.ID)
+			if !found {
+				// Dependencies get a status before their dependents
+				// start, it is missing if they were removed or never
+				// existed.
+				return fmt.Errorf("dependency %q does not exist", d.ID)
+			}
+			ok, err := d.check(st)
+			if err != nil {
+				return fmt.Errorf("dependency %q failed: %v", d.ID, err)
+			}
+			if ok {
+				break
+			}
+			if !logged {
+				logger.Printf("Container %q waiting for %q to be %s", s.ID, d.ID, cond)
+				logged = true
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// validateServices checks data, a service file or a JSON list of
+// containers, that may depend on the IDs in others. Unknown fields are
+// errors, to catch typos and settings caaos no longer supports.
+func validateServices(data []byte, others map[string]bool) error {
+	var svcs []*caaosService
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := dec.Decode(&svcs); err != nil {
+			return err
+		}
+	} else {
+		var svc caaosService
+		if err := dec.Decode(&svc); err != nil {
+			return err
+		}
+		svcs = append(svcs, &svc)
+	}
+	seen := map[string]bool{}
+	for _, svc := range svcs {
+		if err := identifiers.Validate(svc.ID); err != nil {
+			return err
+		}
+		if seen[svc.ID] {
+			return fmt.Errorf("container %q listed twice", svc.ID)
+		}
+		seen[svc.ID] = true
+		if err := svc.validate(); err != nil {
+			return fmt.Errorf("container %q: %v", svc.ID, err)
+		}
+	}
+	return checkDependencies(svcs, others)
+}
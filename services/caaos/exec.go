@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// defaultToolboxImage is the image of debug containers when the request
+// names none.
+var defaultToolboxImage = "docker.io/library/busybox:latest"
+
+// execRequest is the body of an exec call, which runs Args in the
+// container's running task with its process settings.
+type execRequest struct {
+	Args []string
+	// Env is added to the environment of the container's process.
+	Env []string
+	Cwd string
+	// TTY allocates a terminal of Cols by Rows, stderr is then part of
+	// stdout.
+	TTY        bool
+	Cols, Rows uint32
+}
+
+// debugRequest is the body of a debug call, which runs an ephemeral
+// container from Image in the PID and network namespaces of the target. The
+// target's filesystem is reachable at /proc/1/root, caaosctl and the control
+// socket are mounted in.
+type debugRequest struct {
+	execRequest
+	Image string
+	// Privileged debug containers get all capabilities, others only
+	// CAP_SYS_PTRACE on top of the defaults.
+	Privileged bool
+}
+
+// caaosctlPath is where the caaosctl package installs it, debug containers
+// have it at /usr/local/bin/caaosctl.
+var caaosctlPath = "/bin/caaosctl"
+
+// debugLabel marks debug containers, with the ID of their target as value,
+// so that the ones a crashed caaos left behind are removed on its next start.
+const debugLabel = "caaos.debug"
+
+var execID uint64
+
+func decodeRequest(r *http.Request, v interface{}) error {
+	if r.Method != http.MethodPost {
+		return fmt.Errorf("method not allowed")
+	}
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// attach streams the IO of proc over s until it exits, then deletes it. The
+// process is killed if the client goes away first.
+func attach(ctx context.Context, s *streamConn, proc containerd.Process, stdin *io.PipeWriter) {
+	statusC, err := proc.Wait(ctx)
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	if err := proc.Start(ctx); err != nil {
+		proc.Delete(ctx)
+		s.fail(err)
+		return
+	}
+
+	gone := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		s.pump(stdin, func(cols, rows uint32) { proc.Resize(ctx, cols, rows) }, exited)
+		close(gone)
+	}()
+
+	var status containerd.ExitStatus
+	select {
+	case status = <-statusC:
+	case <-gone:
+		proc.Kill(ctx, syscall.SIGKILL)
+		status = <-statusC
+	}
+	close(exited)
+	// Let the output drain before reporting the exit.
+	proc.IO().Wait()
+	proc.Delete(ctx)
+	code, _, err := status.Result()
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	s.exit(code)
+}
+
+func streamCreator(s *streamConn, tty bool) (cio.Creator, *io.PipeWriter) {
+	stdinR, stdinW := io.Pipe()
+	opts := []cio.Opt{cio.WithStreams(stdinR, &frameWriter{s, frameStdout}, &frameWriter{s, frameStderr})}
+	if tty {
+		opts = append(opts, cio.WithTerminal)
+	}
+	return cio.NewCreator(opts...), stdinW
+}
+
+// serveExec runs a process in the task of container id.
+func (c *control) serveExec(w http.ResponseWriter, r *http.Request, id string) {
+	var req execRequest
+	if err := decodeRequest(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Args) == 0 {
+		http.Error(w, "missing Args", http.StatusBadRequest)
+		return
+	}
+	container, err := c.client.LoadContainer(c.ctx, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	task, err := container.Task(c.ctx, nil)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	spec, err := container.Spec(c.ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	pspec := *spec.Process
+	pspec.Args = req.Args
+	pspec.Env = append(append([]string(nil), pspec.Env...), req.Env...)
+	if req.Cwd != "" {
+		pspec.Cwd = req.Cwd
+	}
+	pspec.Terminal = req.TTY
+	pspec.ConsoleSize = nil
+	if req.TTY && req.Cols > 0 && req.Rows > 0 {
+		pspec.ConsoleSize = &specs.Box{Width: uint(req.Cols), Height: uint(req.Rows)}
+	}
+
+	s, err := upgradeStream(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer s.conn.Close()
+
+	logger.Printf("Exec in container %q: %q", id, req.Args)
+	creator, stdin := streamCreator(s, req.TTY)
+	proc, err := task.Exec(c.ctx, fmt.Sprintf("exec-%d", atomic.AddUint64(&execID, 1)), &pspec, creator)
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	attach(c.ctx, s, proc, stdin)
+}
+
+// serveDebug runs an ephemeral container next to the task of container id.
+func (c *control) serveDebug(w http.ResponseWriter, r *http.Request, id string) {
+	var req debugRequest
+	if err := decodeRequest(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Image == "" {
+		req.Image = defaultToolboxImage
+	}
+	target, err := c.client.LoadContainer(c.ctx, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	task, err := target.Task(c.ctx, nil)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	pid := task.Pid()
+
+	s, err := upgradeStream(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer s.conn.Close()
+
+	img, err := pullImage(c.ctx, c.client, req.Image)
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	specOpts := []oci.SpecOpts{
+		oci.WithImageConfig(img),
+		oci.WithLinuxNamespace(specs.LinuxNamespace{Type: specs.PIDNamespace, Path: fmt.Sprintf("/proc/%d/ns/pid", pid)}),
+		oci.WithLinuxNamespace(specs.LinuxNamespace{Type: specs.NetworkNamespace, Path: fmt.Sprintf("/proc/%d/ns/net", pid)}),
+	}
+	if len(req.Args) > 0 {
+		specOpts = append(specOpts, oci.WithProcessArgs(req.Args...))
+	}
+	if len(req.Env) > 0 {
+		specOpts = append(specOpts, oci.WithEnv(req.Env))
+	}
+	if req.Cwd != "" {
+		specOpts = append(specOpts, oci.WithProcessCwd(req.Cwd))
+	}
+	if req.TTY {
+		specOpts = append(specOpts, oci.WithTTY)
+		if req.Cols > 0 && req.Rows > 0 {
+			specOpts = append(specOpts, oci.WithTTYSize(int(req.Cols), int(req.Rows)))
+		}
+	}
+	// caaosctl and its socket, to work on caaos from inside.
+	specOpts = append(specOpts, oci.WithMounts([]specs.Mount{
+		{Destination: "/usr/local/bin/caaosctl", Type: "bind", Source: caaosctlPath, Options: []string{"rbind", "ro"}},
+		{Destination: filepath.Dir(controlSocket), Type: "bind", Source: filepath.Dir(controlSocket), Options: []string{"rbind", "ro"}},
+	}))
+	if req.Privileged {
+		specOpts = append(specOpts, oci.WithPrivileged)
+	} else {
+		specOpts = append(specOpts, oci.WithAddedCapabilities([]string{"CAP_SYS_PTRACE"}))
+	}
+
+	var suffix [4]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		s.fail(err)
+		return
+	}
+	did := fmt.Sprintf("%s-debug-%s", id, hex.EncodeToString(suffix[:]))
+	logger.Printf("Starting debug container %q from %q for %q", did, req.Image, id)
+	container, err := c.client.NewContainer(c.ctx, did,
+		containerd.WithContainerLabels(map[string]string{debugLabel: id}),
+		containerd.WithNewSnapshot(did, img),
+		containerd.WithNewSpec(specOpts...),
+	)
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	defer container.Delete(c.ctx, containerd.WithSnapshotCleanup)
+
+	creator, stdin := streamCreator(s, req.TTY)
+	dtask, err := container.NewTask(c.ctx, creator)
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	attach(c.ctx, s, dtask, stdin)
+	logger.Printf("Debug container %q exited", did)
+}
+
+// removeDebugContainers deletes the debug containers, and their snapshots,
+// an earlier caaos did not get to delete.
+func removeDebugContainers(ctx context.Context, client *containerd.Client) {
+	containers, err := client.Containers(ctx, fmt.Sprintf("labels.%q", debugLabel))
+	if err != nil {
+		logger.Println("Error listing debug containers:", err)
+		return
+	}
+	for _, c := range containers {
+		logger.Printf("Removing stale debug container %q", c.ID())
+		if err := removeContainer(ctx, client, c.ID()); err != nil {
+			logger.Printf("Error removing debug container %q: %v", c.ID(), err)
+		}
+	}
+}
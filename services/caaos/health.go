@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/namespaces"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultProbeInterval = 10 * time.Second
+	defaultProbeTimeout  = time.Second
+	defaultFailures      = 3
+	defaultSuccesses     = 1
+
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+)
+
+// healthCheck has the probes of a container. A container failing its
+// liveness probe is killed, leaving the restart to its RestartPolicy. Its
+// readiness probe decides when it is ready, without one a running container
+// is.
+type healthCheck struct {
+	Liveness  *probe
+	Readiness *probe
+}
+
+// probe checks a container through one of HTTPGet, TCPSocket or Exec. HTTP
+// and TCP probes connect from the container's network namespace, so Host
+// defaults to 127.0.0.1 for containers with their own network too.
+type probe struct {
+	HTTPGet   *httpProbe
+	TCPSocket *tcpProbe
+	Exec      *execProbe
+
+	// InitialDelay, Interval and Timeout are durations like "10s".
+	InitialDelay string
+	Interval     string
+	Timeout      string
+	// FailureThreshold failures in a row make the probe fail,
+	// SuccessThreshold successes in a row make it pass again.
+	FailureThreshold int
+	SuccessThreshold int
+}
+
+type httpProbe struct {
+	Host string
+	Port int
+	Path string
+}
+
+type tcpProbe struct {
+	Host string
+	Port int
+}
+
+type execProbe struct {
+	// Command is run in the container's namespaces, exiting 0 passes.
+	Command []string
+}
+
+func parseDurationOr(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func (p *probe) validate() error {
+	n := 0
+	if p.HTTPGet != nil {
+		n++
+		if p.HTTPGet.Port <= 0 || p.HTTPGet.Port > 65535 {
+			return fmt.Errorf("bad HTTPGet port %d", p.HTTPGet.Port)
+		}
+	}
+	if p.TCPSocket != nil {
+		n++
+		if p.TCPSocket.Port <= 0 || p.TCPSocket.Port > 65535 {
+			return fmt.Errorf("bad TCPSocket port %d", p.TCPSocket.Port)
+		}
+	}
+	if p.Exec != nil {
+		n++
+		if len(p.Exec.Command) == 0 {
+			return fmt.Errorf("empty Exec command")
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("want one of HTTPGet, TCPSocket or Exec, got %d", n)
+	}
+	for _, d := range []string{p.InitialDelay, p.Interval, p.Timeout} {
+		if _, err := parseDurationOr(d, 0); err != nil {
+			return err
+		}
+	}
+	if p.FailureThreshold < 0 || p.SuccessThreshold < 0 {
+		return fmt.Errorf("negative threshold")
+	}
+	return nil
+}
+
+func (h *healthCheck) validate() error {
+	if h.Liveness != nil {
+		if err := h.Liveness.validate(); err != nil {
+			return fmt.Errorf("liveness probe: %v", err)
+		}
+	}
+	if h.Readiness != nil {
+		if err := h.Readiness.validate(); err != nil {
+			return fmt.Errorf("readiness probe: %v", err)
+		}
+	}
+	return nil
+}
+
+// dialInNetns connects to addr from the network namespace of pid. The socket
+// keeps its namespace once the thread switches back.
+func dialInNetns(ctx context.Context, pid uint32, network, addr string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		// The thread is left locked, and so thrown away, if it cannot
+		// switch back to its namespace.
+		runtime.LockOSThread()
+		self, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			ch <- result{nil, err}
+			return
+		}
+		defer self.Close()
+		target, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+		if err != nil {
+			ch <- result{nil, err}
+			return
+		}
+		defer target.Close()
+		if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+			ch <- result{nil, fmt.Errorf("setns: %v", err)}
+			return
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if unix.Setns(int(self.Fd()), unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+		ch <- result{conn, err}
+	}()
+	r := <-ch
+	return r.conn, r.err
+}
+
+func probeHost(host string) string {
+	if host == "" {
+		return "127.0.0.1"
+	}
+	return host
+}
+
+var execProbeID uint64
+
+func (p *probe) check(ctx context.Context, container containerd.Container, task containerd.Task) error {
+	switch {
+	case p.TCPSocket != nil:
+		conn, err := dialInNetns(ctx, task.Pid(), "tcp", net.JoinHostPort(probeHost(p.TCPSocket.Host), strconv.Itoa(p.TCPSocket.Port)))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case p.HTTPGet != nil:
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialInNetns(ctx, task.Pid(), network, addr)
+			},
+			DisableKeepAlives: true,
+		}}
+		url := fmt.Sprintf("http://%s%s", net.JoinHostPort(probeHost(p.HTTPGet.Host), strconv.Itoa(p.HTTPGet.Port)), p.HTTPGet.Path)
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("GET %s: %s", url, resp.Status)
+		}
+		return nil
+
+	case p.Exec != nil:
+		spec, err := container.Spec(ctx)
+		if err != nil {
+			return err
+		}
+		pspec := *spec.Process
+		pspec.Args = p.Exec.Command
+		pspec.Terminal = false
+		id := fmt.Sprintf("probe-%d", atomic.AddUint64(&execProbeID, 1))
+		// The probe's own context may run out, clean up regardless.
+		bg := context.Background()
+		if ns, ok := namespaces.Namespace(ctx); ok {
+			bg = namespaces.WithNamespace(bg, ns)
+		}
+		proc, err := task.Exec(bg, id, &pspec, cio.NullIO)
+		if err != nil {
+			return err
+		}
+		defer proc.Delete(bg, containerd.WithProcessKill)
+		statusC, err := proc.Wait(bg)
+		if err != nil {
+			return err
+		}
+		if err := proc.Start(bg); err != nil {
+			return err
+		}
+		select {
+		case status := <-statusC:
+			code, _, err := status.Result()
+			if err != nil {
+				return err
+			}
+			if code != 0 {
+				return fmt.Errorf("%q exited with code %d", p.Exec.Command, code)
+			}
+			return nil
+		case <-ctx.Done():
+			proc.Kill(bg, syscall.SIGKILL)
+			<-statusC
+			return fmt.Errorf("%q timed out", p.Exec.Command)
+		}
+	}
+	return fmt.Errorf("no probe set")
+}
+
+// run checks the probe until ctx is done, calling update with the result
+// each time the probe passes or fails after crossing its threshold.
+func (p *probe) run(ctx context.Context, container containerd.Container, task containerd.Task, update func(ok bool, err error)) {
+	initial, _ := parseDurationOr(p.InitialDelay, 0)
+	interval, _ := parseDurationOr(p.Interval, defaultProbeInterval)
+	timeout, _ := parseDurationOr(p.Timeout, defaultProbeTimeout)
+	failures, successes := p.FailureThreshold, p.SuccessThreshold
+	if failures == 0 {
+		failures = defaultFailures
+	}
+	if successes == 0 {
+		successes = defaultSuccesses
+	}
+
+	if sleepContext(ctx, initial) != nil {
+		return
+	}
+	failed, passed := 0, 0
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := p.check(checkCtx, container, task)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			failed++
+			passed = 0
+			if failed >= failures {
+				update(false, err)
+			}
+		} else {
+			passed++
+			failed = 0
+			if passed >= successes {
+				update(true, nil)
+			}
+		}
+		if sleepContext(ctx, interval) != nil {
+			return
+		}
+	}
+}
+
+// runProbes runs the probes of hc against task until ctx is done.
+func runProbes(ctx context.Context, hc *healthCheck, container containerd.Container, task containerd.Task) {
+	id := container.ID()
+	if hc.Readiness != nil {
+		go hc.Readiness.run(ctx, container, task, func(ok bool, err error) {
+			statuses.update(id, func(st *containerStatus) {
+				if st.Ready != ok {
+					if ok {
+						logger.Printf("Container %q is ready", id)
+					} else {
+						logger.Printf("Container %q is not ready: %v", id, err)
+					}
+				}
+				st.Ready = ok
+				st.LastProbeError = errString(err)
+			})
+		})
+	}
+	if hc.Liveness != nil {
+		go hc.Liveness.run(ctx, container, task, func(ok bool, err error) {
+			health := healthHealthy
+			if !ok {
+				health = healthUnhealthy
+			}
+			statuses.update(id, func(st *containerStatus) {
+				st.Health = health
+				st.LastProbeError = errString(err)
+			})
+			if !ok {
+				logger.Printf("Container %q failed its liveness probe, killing it: %v", id, err)
+				task.Kill(ctx, syscall.SIGKILL)
+			}
+		})
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
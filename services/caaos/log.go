@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/adjackura/ecl/internal/logpipe"
+)
+
+// logTailLines is the number of lines of each container kept for the
+// control API.
+const logTailLines = 500
+
+// logs keeps writers from blocking on the console.
+var logs = logpipe.New(os.Stdout, dropMarker)
+
+// dropMarker is the line reporting n lines of name were dropped.
+func dropMarker(name string, n int) string {
+	return fmt.Sprintf("[%s] %d lines dropped\n", name, n)
+}
+
+// logTail keeps the last lines of each container and passes new ones to
+// followers. It sees every line, including those dropped from the console.
+type logTail struct {
+	mu    sync.Mutex
+	lines map[string][]string
+	subs  map[string]map[chan string]struct{}
+}
+
+var tails = &logTail{lines: map[string][]string{}, subs: map[string]map[chan string]struct{}{}}
+
+func (t *logTail) add(source string, lines []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := append(t.lines[source], lines...)
+	if len(l) > logTailLines {
+		l = append([]string(nil), l[len(l)-logTailLines:]...)
+	}
+	t.lines[source] = l
+	for c := range t.subs[source] {
+		for _, line := range lines {
+			// A follower that does not keep up misses lines.
+			select {
+			case c <- line:
+			default:
+			}
+		}
+	}
+}
+
+// follow returns the last n lines of source, all with n < 0, and a channel
+// of the lines written after them.
+func (t *logTail) follow(source string, n int) ([]string, <-chan string, func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.lines[source]
+	if n >= 0 && n < len(l) {
+		l = l[len(l)-n:]
+	}
+	c := make(chan string, 256)
+	if t.subs[source] == nil {
+		t.subs[source] = map[chan string]struct{}{}
+	}
+	t.subs[source][c] = struct{}{}
+	cancel := func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.subs[source], c)
+	}
+	return append([]string(nil), l...), c, cancel
+}
+
+type consoleWriter struct {
+	name string
+}
+
+func (w *consoleWriter) Write(b []byte) (int, error) {
+	var msg string
+	lines := bytes.Split(bytes.TrimRight(b, "\n"), []byte("\n"))
+	tail := make([]string, len(lines))
+	for i, b := range lines {
+		msg += fmt.Sprintf("[%s] %s\n", w.name, b)
+		tail[i] = string(b)
+	}
+	logs.Write(w.name, msg, len(lines))
+	tails.add(w.name, tail)
+	return len(b), nil
+}
@@ -1,106 +1,40 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
-	"syscall"
 	"time"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cio"
 	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/oci"
 	"github.com/opencontainers/runtime-spec/specs-go"
 )
 
-const (
-	metadataURL  = "http://metadata.google.internal/computeMetadata/v1/instance/attributes"
-	metadataHang = "/?recursive=true&alt=json&wait_for_change=true&timeout_sec=120&last_etag="
-	defaultEtag  = "NONE"
-)
+// caaosNamespace is the containerd namespace of the caaos containers.
+const caaosNamespace = "caaos"
 
 var (
-	defaultTimeout = 130 * time.Second
-	etag           = defaultEtag
-	writerChan     = make(chan string, 10)
-
 	logger = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
 )
 
 type attributesJSON struct {
+	// Containers is a JSON list of caaosService, the containers to run.
+	Containers        string `json:"containers"`
 	ContainerRef      string `json:"container-ref"`
 	ContainerSpec     string `json:"container-spec"`
 	OverwriteDefaults bool   `json:"overwrite-defaults,string"`
 	StopOnExit        bool   `json:"stop-on-exit,string"`
 }
 
-func updateEtag(resp *http.Response) bool {
-	oldEtag := etag
-	etag = resp.Header.Get("etag")
-	if etag == "" {
-		etag = defaultEtag
-	}
-	return etag == oldEtag
-}
-
-func watchMetadata(ctx context.Context) (*attributesJSON, error) {
-	client := &http.Client{
-		Timeout: defaultTimeout,
-	}
-
-	req, err := http.NewRequest("GET", metadataURL+metadataHang+etag, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("Metadata-Flavor", "Google")
-	req = req.WithContext(ctx)
-
-	for {
-		resp, err := client.Do(req)
-		// Don't return error on a canceled context.
-		if err != nil && ctx.Err() != nil {
-			return nil, nil
-		}
-		if err != nil {
-			return nil, err
-		}
-
-		// Only return metadata on updated etag.
-		if updateEtag(resp) {
-			continue
-		}
-
-		md, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			return nil, err
-		}
-		var attr attributesJSON
-		return &attr, json.Unmarshal(md, &attr)
-	}
-}
-
-type consoleWriter struct {
-	name string
-}
-
-func (w *consoleWriter) Write(b []byte) (int, error) {
-	var msg string
-	for _, b := range bytes.Split(bytes.TrimRight(b, "\n"), []byte("\n")) {
-		msg += fmt.Sprintf("[%s] %s\n", w.name, b)
-	}
-	writerChan <- msg
-	return len(b), nil
-}
-
 func withSpecFromBytes(p []byte, clear bool) oci.SpecOpts {
 	return func(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
 		if clear {
@@ -113,92 +47,107 @@ func withSpecFromBytes(p []byte, clear bool) oci.SpecOpts {
 	}
 }
 
-func runContainer(ctx context.Context, container containerd.Container) error {
+// runContainer runs a task of container, probing it as hc says, and returns
+// its exit code.
+func runContainer(ctx context.Context, container containerd.Container, hc healthCheck) (uint32, error) {
 	s, _ := container.Spec(ctx)
 	d, _ := json.Marshal(s)
 	fmt.Printf("%q container spec: %s\n", container.ID(), string(d))
 
+	// drop a task left by an earlier run
+	if task, err := container.Task(ctx, nil); err == nil {
+		if _, err := task.Delete(ctx, containerd.WithProcessKill); err != nil {
+			return 0, err
+		}
+	}
+
 	// create a new task
 	w := &consoleWriter{name: container.ID()}
 	task, err := container.NewTask(ctx, cio.NewCreator(cio.WithStreams(os.Stdin, w, w)))
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer func() {
+		if _, err := task.Delete(ctx); err != nil {
+			logger.Println(err)
+		}
+	}()
 
 	// Setup wait channel
 	statusC, err := task.Wait(ctx)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// start the task
 	logger.Printf("Starting task for container %q", container.ID())
+	started := time.Now()
 	if err := task.Start(ctx); err != nil {
-		return err
+		return 0, err
 	}
+	statuses.update(container.ID(), func(st *containerStatus) {
+		st.State = stateRunning
+		st.StartedAt = started
+		st.PID = task.Pid()
+		st.Ready = hc.Readiness == nil
+	})
+	probeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	runProbes(probeCtx, &hc, container, task)
 
 	// wait for the task to exit and get the exit status
 	logger.Printf("Waiting for %q...", container.ID())
 	status := <-statusC
 	code, _, err := status.Result()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	logger.Printf("Return code for %q: %d", container.ID(), code)
-
-	if _, err := task.Delete(ctx); err != nil {
-		logger.Println(err)
+	if code != 0 {
+		logCoredumps(container.ID(), started)
 	}
-
-	return nil
+	return code, nil
 }
 
-func runContainerFromImage(ctx context.Context, client *containerd.Client, ref string, spec string, clear bool) error {
-	logger.Printf("Recieved request to run %q", ref)
-
-	var img containerd.Image
-	imgs, err := client.ListImages(ctx)
-	if err != nil {
-		return fmt.Errorf("error listing images: %v", err)
-	}
-	for _, i := range imgs {
-		if i.Name() == ref {
-			logger.Println("Image found in local registry")
-			img = i
-		}
+// pullImage returns the image ref, pulling it if it is not in the local
+// registry.
+func pullImage(ctx context.Context, client *containerd.Client, ref string) (containerd.Image, error) {
+	img, err := client.GetImage(ctx, ref)
+	if err == nil {
+		logger.Printf("Image %q found in local registry", ref)
+		return img, nil
 	}
-
-	if img == nil {
-		logger.Println("Image not found in local registry, pulling now")
-		img, err = client.Pull(ctx, ref, containerd.WithPullUnpack)
-		if err != nil {
-			return fmt.Errorf("error pulling image: %v", err)
-		}
+	if !errdefs.IsNotFound(err) {
+		return nil, fmt.Errorf("error looking up image: %v", err)
 	}
-
-	id := fmt.Sprintf("%d", time.Now().Unix())
-	logger.Println("Creating container")
-	container, err := client.NewContainer(
-		ctx,
-		id,
-		containerd.WithNewSnapshot(id, img),
-		containerd.WithNewSpec(oci.WithImageConfig(img), withSpecFromBytes([]byte(spec), clear)),
-	)
+	logger.Printf("Image %q not found in local registry, pulling now", ref)
+	img, err = client.Pull(ctx, ref, containerd.WithPullUnpack)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("error pulling image: %v", err)
 	}
-	defer container.Delete(ctx, containerd.WithSnapshotCleanup)
-
-	return runContainer(ctx, container)
+	return img, nil
 }
 
 type caaosService struct {
-	ID, Delay                                                           string
+	ID                                                                  string
 	FullSpec                                                            bool
 	WithPrivileged, WithAllDevicesAllowed, WithHostDevices, WithNetHost bool
 	Mounts                                                              []specs.Mount
 	OCISpec                                                             json.RawMessage
+	// Image is pulled for the root filesystem and process defaults, which
+	// OCISpec is applied on top of.
+	Image string
+	// StopOnExit powers the machine off once the container exits and is
+	// not restarted.
+	StopOnExit    bool
+	RestartPolicy restartPolicy
+	// DependsOn are containers to wait for before starting this one.
+	DependsOn   []dependency
+	HealthCheck healthCheck
+	// Delay was replaced by DependsOn, it is only read to reject services
+	// still setting it.
+	Delay json.RawMessage `json:",omitempty"`
 }
 
 func withHostCACertsFile(_ context.Context, _ oci.Client, _ *containers.Container, s *oci.Spec) error {
@@ -226,9 +175,20 @@ func (s *caaosService) getContainer(ctx context.Context, client *containerd.Clie
 	specOpts := []oci.SpecOpts{
 		oci.WithDefaultSpec(),
 		oci.WithDefaultUnixDevices,
-		withSpecFromBytes([]byte(s.OCISpec), s.FullSpec),
-		oci.WithMounts(s.Mounts),
 	}
+	var opts []containerd.NewContainerOpts
+	if s.Image != "" {
+		img, err := pullImage(ctx, client, s.Image)
+		if err != nil {
+			return nil, err
+		}
+		specOpts = append(specOpts, oci.WithImageConfig(img))
+		opts = append(opts, containerd.WithNewSnapshot(s.ID, img))
+	}
+	if len(s.OCISpec) > 0 {
+		specOpts = append(specOpts, withSpecFromBytes([]byte(s.OCISpec), s.FullSpec))
+	}
+	specOpts = append(specOpts, oci.WithMounts(s.Mounts))
 	if s.WithNetHost {
 		specOpts = append(specOpts, oci.WithHostNamespace(specs.NetworkNamespace), oci.WithHostHostsFile, oci.WithHostResolvconf, withHostCACertsFile)
 	}
@@ -242,31 +202,8 @@ func (s *caaosService) getContainer(ctx context.Context, client *containerd.Clie
 		specOpts = append(specOpts, oci.WithHostDevices)
 	}
 
-	return client.NewContainer(
-		ctx,
-		s.ID,
-		containerd.WithNewSpec(specOpts...),
-	)
-}
-
-func (s *caaosService) start(ctx context.Context, client *containerd.Client) {
-	if s.Delay != "" {
-		if d, err := time.ParseDuration(s.Delay); err != nil {
-			logger.Println("Error parsing delay:", err)
-		} else {
-			time.Sleep(d)
-		}
-	}
-
-	container, err := s.getContainer(ctx, client)
-	if err != nil {
-		logger.Println("Error:", err)
-		return
-	}
-
-	if err := runContainer(ctx, container); err != nil {
-		logger.Println("Error:", err)
-	}
+	opts = append(opts, containerd.WithNewSpec(specOpts...))
+	return client.NewContainer(ctx, s.ID, opts...)
 }
 
 func loadServices() []*caaosService {
@@ -291,15 +228,30 @@ func loadServices() []*caaosService {
 			logger.Println(err)
 			continue
 		}
+		if err := svc.validate(); err != nil {
+			logger.Printf("%s: %v", svcFile.Name(), err)
+			continue
+		}
 
 		caaosServices = append(caaosServices, &svc)
 	}
+
+	if err := checkDependencies(caaosServices, nil); err != nil {
+		logger.Println("Error in service dependencies, not starting services with dependencies:", err)
+		var ok []*caaosService
+		for _, svc := range caaosServices {
+			if len(svc.DependsOn) == 0 {
+				ok = append(ok, svc)
+			}
+		}
+		caaosServices = ok
+	}
 	return caaosServices
 }
 
 func main() {
 	logger.Println("Starting caaos...")
-	ctx := namespaces.WithNamespace(context.Background(), "caaos")
+	ctx := namespaces.WithNamespace(context.Background(), caaosNamespace)
 
 	logger.Println("Reading caaos service files")
 	svcs := loadServices()
@@ -311,49 +263,43 @@ func main() {
 	}
 	defer client.Close()
 
-	go func() {
-		for {
-			select {
-			case s := <-writerChan:
-				os.Stdout.WriteString(s)
-			}
-		}
-	}()
+	go logs.Run()
 
-	logger.Println("Starting caaos services")
-	for _, svc := range svcs {
-		logger.Println("Starting", svc.ID)
-		go svc.start(ctx, client)
+	mdConfig, err := loadMetadataConfig()
+	if err != nil {
+		logger.Fatalln("Error reading metadata config:", err)
 	}
+	provider, err := newMetadataProvider(mdConfig)
+	if err != nil {
+		logger.Fatalln("Error creating metadata provider:", err)
+	}
+	logger.Printf("Using %s metadata provider", mdConfig.Provider)
 
-	for {
-		logger.Println("Waiting for metadata...")
-		md, err := watchMetadata(ctx)
-		if err != nil {
-			logger.Println("Error grabing metadata:", err)
-			time.Sleep(1 * time.Second)
-			continue
-		}
+	removeDebugContainers(ctx, client)
 
-		if md.ContainerRef == "" {
-			logger.Println("No container set, waiting...")
-			continue
-		}
+	r := newReconciler(client, svcs)
+	logger.Println("Starting caaos services")
+	r.startServices(ctx, svcs)
 
-		if err := runContainerFromImage(ctx, client, md.ContainerRef, md.ContainerSpec, md.OverwriteDefaults); err != nil {
-			logger.Println("Error:", err)
-			time.Sleep(5 * time.Second)
-		}
+	watcher := newMetadataWatcher(provider)
+	go watcher.run(ctx)
 
-		if md.StopOnExit {
-			logger.Printf("Finished running %s, shutting down", md.ContainerRef)
-			syscall.Sync()
-			if err := syscall.Reboot(syscall.LINUX_REBOOT_CMD_POWER_OFF); err != nil {
-				logger.Println("Error calling shutdown:", err)
-			}
-			select {}
+	go func() {
+		if err := runControl(ctx, client, r, watcher); err != nil {
+			logger.Println("Error serving control API:", err)
 		}
+	}()
 
-		logger.Printf("Finished running %s, waiting for next command...", md.ContainerRef)
+	logger.Println("Waiting for metadata...")
+	for md := range watcher.updates {
+		desired, err := md.services()
+		if err == nil {
+			err = checkDependencies(desired, r.reserved)
+		}
+		if err != nil {
+			logger.Println("Error in metadata:", err)
+			continue
+		}
+		r.reconcile(ctx, desired, false)
 	}
 }
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// metadataConfigFile selects the metadata provider, without it the GCE
+	// metadata server is used. The caaos.metadata kernel parameter, e.g.
+	// caaos.metadata=file:/var/lib/caaos/attributes.json or
+	// caaos.metadata=http://10.0.2.2:8080/attributes, overrides it.
+	metadataConfigFile = "/var/lib/caaos/metadata.json"
+
+	defaultPollInterval = 10 * time.Second
+)
+
+const (
+	gceMetadataURL  = "http://metadata.google.internal/computeMetadata/v1/instance/attributes"
+	gceMetadataHang = "/?recursive=true&alt=json&wait_for_change=true&timeout_sec=120&last_etag="
+	defaultEtag     = "NONE"
+	imdsURL         = "http://169.254.169.254"
+)
+
+// metadataProvider is a source of instance attributes, a JSON object of
+// string values.
+type metadataProvider interface {
+	// watch returns the attributes once their version differs from
+	// version, "" returns the current attributes right away.
+	watch(ctx context.Context, version string) (attrs []byte, newVersion string, err error)
+}
+
+type metadataConfig struct {
+	// Provider is gce, http, file or imds.
+	Provider string
+	// URL of the http provider, for imds the base URL of the service.
+	URL string `json:",omitempty"`
+	// Headers sent by the http provider.
+	Headers map[string]string `json:",omitempty"`
+	// Path of the JSON file of the file provider.
+	Path string `json:",omitempty"`
+	// Flavor of the imds provider: ec2, attributes are the user data, or
+	// openstack, attributes are the meta of meta_data.json.
+	Flavor string `json:",omitempty"`
+	// Interval between polls of the http and imds providers.
+	Interval string `json:",omitempty"`
+}
+
+// loadMetadataConfig reads the provider config from the kernel command line
+// or metadataConfigFile.
+func loadMetadataConfig() (*metadataConfig, error) {
+	cmdline, _ := ioutil.ReadFile("/proc/cmdline")
+	for _, arg := range strings.Fields(string(cmdline)) {
+		if !strings.HasPrefix(arg, "caaos.metadata=") {
+			continue
+		}
+		v := strings.TrimPrefix(arg, "caaos.metadata=")
+		switch {
+		case strings.HasPrefix(v, "file:"):
+			return &metadataConfig{Provider: "file", Path: strings.TrimPrefix(v, "file:")}, nil
+		case strings.HasPrefix(v, "http://"), strings.HasPrefix(v, "https://"):
+			return &metadataConfig{Provider: "http", URL: v}, nil
+		case v == "gce", v == "imds":
+			return &metadataConfig{Provider: v}, nil
+		case strings.HasPrefix(v, "imds:"):
+			return &metadataConfig{Provider: "imds", Flavor: strings.TrimPrefix(v, "imds:")}, nil
+		}
+		return nil, fmt.Errorf("bad caaos.metadata=%s", v)
+	}
+
+	data, err := ioutil.ReadFile(metadataConfigFile)
+	if os.IsNotExist(err) {
+		return &metadataConfig{Provider: "gce"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c metadataConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", metadataConfigFile, err)
+	}
+	if c.Provider == "" {
+		c.Provider = "gce"
+	}
+	return &c, nil
+}
+
+// dialTimeout is shorter than the request timeouts, so that a provider not
+// reachable fails dialing rather than timing out like a slow answer.
+const dialTimeout = 10 * time.Second
+
+func newWatchClient(timeout time.Duration) *http.Client {
+	d := &net.Dialer{Timeout: dialTimeout}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: d.DialContext},
+	}
+}
+
+func newMetadataProvider(c *metadataConfig) (metadataProvider, error) {
+	interval := defaultPollInterval
+	if c.Interval != "" {
+		d, err := time.ParseDuration(c.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("bad Interval: %v", err)
+		}
+		interval = d
+	}
+	switch c.Provider {
+	case "", "gce":
+		return &gceProvider{client: newWatchClient(130 * time.Second)}, nil
+	case "http":
+		if c.URL == "" {
+			return nil, fmt.Errorf("http provider needs a URL")
+		}
+		return &httpProvider{url: c.URL, headers: c.Headers, interval: interval, client: newWatchClient(30 * time.Second)}, nil
+	case "file":
+		if c.Path == "" {
+			return nil, fmt.Errorf("file provider needs a Path")
+		}
+		return &fileProvider{path: c.Path}, nil
+	case "imds":
+		base := c.URL
+		if base == "" {
+			base = imdsURL
+		}
+		switch c.Flavor {
+		case "", "ec2", "openstack":
+		default:
+			return nil, fmt.Errorf("unknown imds flavor %q", c.Flavor)
+		}
+		return &imdsProvider{base: strings.TrimSuffix(base, "/"), flavor: c.Flavor, interval: interval, client: newWatchClient(30 * time.Second)}, nil
+	}
+	return nil, fmt.Errorf("unknown metadata provider %q", c.Provider)
+}
+
+func hashVersion(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func readResponse(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Request.URL, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// gceProvider long-polls the GCE metadata server.
+type gceProvider struct {
+	client *http.Client
+}
+
+func (p *gceProvider) watch(ctx context.Context, version string) ([]byte, string, error) {
+	etag := version
+	if etag == "" {
+		etag = defaultEtag
+	}
+	for {
+		req, err := http.NewRequestWithContext(ctx, "GET", gceMetadataURL+gceMetadataHang+etag, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		req.Header.Add("Metadata-Flavor", "Google")
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		attrs, err := readResponse(resp)
+		if err != nil {
+			return nil, "", err
+		}
+		newEtag := resp.Header.Get("etag")
+		if newEtag == "" {
+			newEtag = defaultEtag
+		}
+		// The server answers with the same etag when the wait times out.
+		if version == "" || newEtag != etag {
+			return attrs, newEtag, nil
+		}
+	}
+}
+
+// httpProvider polls an HTTP endpoint serving the attributes, using ETags
+// to detect changes. Without an ETag from the server the content is
+// compared.
+type httpProvider struct {
+	url      string
+	headers  map[string]string
+	interval time.Duration
+	client   *http.Client
+}
+
+func (p *httpProvider) watch(ctx context.Context, version string) ([]byte, string, error) {
+	for first := true; ; first = false {
+		if !first {
+			if err := sleepContext(ctx, p.interval); err != nil {
+				return nil, "", err
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", p.url, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		for k, v := range p.headers {
+			req.Header.Set(k, v)
+		}
+		if strings.HasPrefix(version, `"`) || strings.HasPrefix(version, `W/"`) {
+			req.Header.Set("If-None-Match", version)
+		}
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		if resp.StatusCode == http.StatusNotModified {
+			resp.Body.Close()
+			continue
+		}
+		attrs, err := readResponse(resp)
+		if err != nil {
+			return nil, "", err
+		}
+		newVersion := resp.Header.Get("ETag")
+		if newVersion == "" {
+			newVersion = hashVersion(attrs)
+		}
+		if newVersion != version {
+			return attrs, newVersion, nil
+		}
+	}
+}
+
+// fileProvider reads the attributes from a local JSON file and watches it
+// with inotify. Replacing the file by a rename is seen as well.
+type fileProvider struct {
+	path string
+}
+
+func (p *fileProvider) read() ([]byte, string, error) {
+	attrs, err := ioutil.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		attrs, err = []byte("{}"), nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return attrs, hashVersion(attrs), nil
+}
+
+func (p *fileProvider) watch(ctx context.Context, version string) ([]byte, string, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, "", err
+	}
+	defer unix.Close(fd)
+	dir := filepath.Dir(p.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, "", err
+	}
+	if _, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_MOVED_FROM|unix.IN_CREATE|unix.IN_DELETE); err != nil {
+		return nil, "", err
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		// Read after setting up the watch so no change is missed.
+		attrs, v, err := p.read()
+		if err != nil || v != version {
+			return attrs, v, err
+		}
+		for changed := false; !changed; {
+			fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+			// Poll in steps to notice a canceled context.
+			if _, err := unix.Poll(fds, 1000); err != nil && err != unix.EINTR {
+				return nil, "", err
+			}
+			if ctx.Err() != nil {
+				return nil, "", ctx.Err()
+			}
+			n, err := unix.Read(fd, buf)
+			if err == unix.EAGAIN {
+				continue
+			}
+			if err != nil {
+				return nil, "", err
+			}
+			for off := 0; off+unix.SizeofInotifyEvent <= n; {
+				ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				name := string(bytes.TrimRight(buf[off+unix.SizeofInotifyEvent:off+unix.SizeofInotifyEvent+int(ev.Len)], "\x00"))
+				if name == filepath.Base(p.path) {
+					changed = true
+				}
+				off += unix.SizeofInotifyEvent + int(ev.Len)
+			}
+		}
+	}
+}
+
+// imdsProvider polls an EC2 or OpenStack style instance metadata service.
+// On EC2 the attributes are the instance's user data, fetched with an
+// IMDSv2 session token, on OpenStack the meta of meta_data.json.
+type imdsProvider struct {
+	base     string
+	flavor   string
+	interval time.Duration
+	client   *http.Client
+}
+
+func (p *imdsProvider) ec2Token(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", p.base+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	token, err := readResponse(resp)
+	return string(token), err
+}
+
+func (p *imdsProvider) fetch(ctx context.Context) ([]byte, error) {
+	if p.flavor == "openstack" {
+		req, err := http.NewRequestWithContext(ctx, "GET", p.base+"/openstack/latest/meta_data.json", nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		data, err := readResponse(resp)
+		if err != nil {
+			return nil, err
+		}
+		var md struct {
+			Meta json.RawMessage `json:"meta"`
+		}
+		if err := json.Unmarshal(data, &md); err != nil {
+			return nil, err
+		}
+		if md.Meta == nil {
+			return []byte("{}"), nil
+		}
+		return md.Meta, nil
+	}
+
+	token, err := p.ec2Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting token: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", p.base+"/latest/user-data", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// No user data is served as a 404.
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return []byte("{}"), nil
+	}
+	return readResponse(resp)
+}
+
+func (p *imdsProvider) watch(ctx context.Context, version string) ([]byte, string, error) {
+	for first := true; ; first = false {
+		if !first {
+			if err := sleepContext(ctx, p.interval); err != nil {
+				return nil, "", err
+			}
+		}
+		attrs, err := p.fetch(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		if v := hashVersion(attrs); v != version {
+			return attrs, v, nil
+		}
+	}
+}
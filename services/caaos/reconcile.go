@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/identifiers"
+)
+
+const (
+	// legacyContainerID runs the container of the container-ref attribute.
+	legacyContainerID = "metadata-container"
+	// stopTimeout is how long a container has to exit on SIGTERM.
+	stopTimeout = 10 * time.Second
+)
+
+// services returns the containers the metadata asks for.
+func (md *attributesJSON) services() ([]*caaosService, error) {
+	var svcs []*caaosService
+	if md.Containers != "" {
+		if err := json.Unmarshal([]byte(md.Containers), &svcs); err != nil {
+			return nil, fmt.Errorf("containers: %v", err)
+		}
+	}
+	if md.ContainerRef != "" {
+		svc := &caaosService{
+			ID:         legacyContainerID,
+			Image:      md.ContainerRef,
+			FullSpec:   md.OverwriteDefaults,
+			StopOnExit: md.StopOnExit,
+		}
+		if md.ContainerSpec != "" {
+			svc.OCISpec = json.RawMessage(md.ContainerSpec)
+		}
+		svcs = append(svcs, svc)
+	}
+
+	seen := map[string]bool{}
+	for _, svc := range svcs {
+		if err := identifiers.Validate(svc.ID); err != nil {
+			return nil, err
+		}
+		if err := svc.validate(); err != nil {
+			return nil, fmt.Errorf("container %q: %v", svc.ID, err)
+		}
+		if seen[svc.ID] {
+			return nil, fmt.Errorf("container %q listed twice", svc.ID)
+		}
+		seen[svc.ID] = true
+	}
+	return svcs, nil
+}
+
+func (s *caaosService) hash() string {
+	b, _ := json.Marshal(s)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// managedContainer is a container supervised by caaos.
+type managedContainer struct {
+	svc  *caaosService
+	hash string
+	// cancel aborts pulling and creating the container.
+	cancel context.CancelFunc
+	done   chan struct{}
+	// stopped is set, with reconciler.mu held, when it is stopped on
+	// request.
+	stopped bool
+}
+
+// finished reports whether the container exited for good or was stopped.
+func (m *managedContainer) finished() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// retry reports whether a reconcile on request starts m again, which it
+// does if m failed for good but not if it exited successfully or was
+// stopped on request.
+func (m *managedContainer) retry() bool {
+	if m.stopped || !m.finished() {
+		return false
+	}
+	st, _ := statuses.get(m.svc.ID)
+	return st.State == stateFailed
+}
+
+var (
+	errUnknownContainer = errors.New("no such container")
+	errAlreadyRunning   = errors.New("container already running")
+)
+
+// reconciler runs the services from /etc/caaos and the containers listed in
+// the metadata, replacing the latter as their specs change.
+type reconciler struct {
+	client *containerd.Client
+	// reconciling serializes reconcile, which stops containers without
+	// holding mu.
+	reconciling sync.Mutex
+
+	mu sync.Mutex
+	// reserved are the IDs of the services from /etc/caaos.
+	reserved map[string]bool
+	running  map[string]*managedContainer
+	// desired are the containers last listed in the metadata.
+	desired []*caaosService
+}
+
+func newReconciler(client *containerd.Client, svcs []*caaosService) *reconciler {
+	r := &reconciler{
+		client:   client,
+		reserved: map[string]bool{},
+		running:  map[string]*managedContainer{},
+	}
+	for _, svc := range svcs {
+		r.reserved[svc.ID] = true
+	}
+	return r
+}
+
+// fileServices returns the IDs of the services from /etc/caaos.
+func (r *reconciler) fileServices() map[string]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := map[string]bool{}
+	for id := range r.reserved {
+		ids[id] = true
+	}
+	return ids
+}
+
+// start runs svc in the background, with r.mu held.
+func (r *reconciler) start(ctx context.Context, svc *caaosService) {
+	r.startAll(ctx, []*caaosService{svc})
+}
+
+// startAll runs svcs in the background, with r.mu held. They all get a
+// status before any of them runs so that dependents find their
+// dependencies.
+func (r *reconciler) startAll(ctx context.Context, svcs []*caaosService) {
+	for _, svc := range svcs {
+		id := svc.ID
+		statuses.update(id, func(st *containerStatus) { *st = containerStatus{ID: id, State: stateWaiting} })
+	}
+	for _, svc := range svcs {
+		setup, cancel := context.WithCancel(ctx)
+		m := &managedContainer{svc: svc, hash: svc.hash(), cancel: cancel, done: make(chan struct{})}
+		r.running[svc.ID] = m
+		go r.run(ctx, setup, m)
+	}
+}
+
+// startServices starts the services from /etc/caaos.
+func (r *reconciler) startServices(ctx context.Context, svcs []*caaosService) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, svc := range svcs {
+		logger.Println("Starting", svc.ID)
+	}
+	r.startAll(ctx, svcs)
+}
+
+// reconcile stops the metadata containers no longer wanted or whose spec
+// changed, then starts the missing ones. With restartFinished containers
+// that failed are started again too.
+func (r *reconciler) reconcile(ctx context.Context, desired []*caaosService, restartFinished bool) {
+	r.reconciling.Lock()
+	defer r.reconciling.Unlock()
+
+	r.mu.Lock()
+	r.desired = desired
+	want := map[string]*caaosService{}
+	for _, svc := range desired {
+		if r.reserved[svc.ID] {
+			logger.Printf("Ignoring metadata container %q, a service file uses that ID", svc.ID)
+			continue
+		}
+		want[svc.ID] = svc
+	}
+	var stale []*managedContainer
+	for id, m := range r.running {
+		if r.reserved[id] {
+			continue
+		}
+		svc, ok := want[id]
+		switch {
+		case !ok:
+			logger.Printf("Container %q removed from metadata, stopping it", id)
+		case svc.hash() != m.hash:
+			logger.Printf("Container %q changed in metadata, replacing it", id)
+		case restartFinished && m.retry():
+		default:
+			continue
+		}
+		delete(r.running, id)
+		stale = append(stale, m)
+	}
+	r.mu.Unlock()
+
+	// Stopping takes up to stopTimeout, the control API keeps answering
+	// meanwhile. The stale containers are out of r.running so no one
+	// starts them again before they are gone.
+	var wg sync.WaitGroup
+	for _, m := range stale {
+		wg.Add(1)
+		go func(m *managedContainer) {
+			defer wg.Done()
+			r.stop(ctx, m)
+			// Replaced containers keep theirs so that dependents
+			// waiting for them do not fail.
+			if want[m.svc.ID] == nil {
+				statuses.remove(m.svc.ID)
+			}
+		}(m)
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var start []*caaosService
+	for _, svc := range desired {
+		if _, ok := r.running[svc.ID]; ok || want[svc.ID] == nil {
+			continue
+		}
+		logger.Printf("Starting metadata container %q", svc.ID)
+		start = append(start, svc)
+	}
+	r.startAll(ctx, start)
+}
+
+// reconcileAgain reconciles the containers last listed in the metadata,
+// starting the ones that are not running.
+func (r *reconciler) reconcileAgain(ctx context.Context) {
+	r.mu.Lock()
+	desired := r.desired
+	r.mu.Unlock()
+	r.reconcile(ctx, desired, true)
+}
+
+// startContainer starts a container that exited or was stopped.
+func (r *reconciler) startContainer(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.running[id]
+	if !ok {
+		return errUnknownContainer
+	}
+	if !m.finished() {
+		return errAlreadyRunning
+	}
+	logger.Printf("Starting container %q on request", id)
+	r.start(ctx, m.svc)
+	return nil
+}
+
+// lookup returns the managed container id.
+func (r *reconciler) lookup(id string) (*managedContainer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.running[id]
+	if !ok {
+		return nil, errUnknownContainer
+	}
+	return m, nil
+}
+
+// stopContainer stops a container, it stays stopped until started again or
+// its spec changes.
+func (r *reconciler) stopContainer(ctx context.Context, id string) error {
+	r.mu.Lock()
+	m, ok := r.running[id]
+	if ok {
+		// Before stopping so that no reconcile starts it again meanwhile.
+		m.stopped = true
+	}
+	r.mu.Unlock()
+	if !ok {
+		return errUnknownContainer
+	}
+	logger.Printf("Stopping container %q on request", id)
+	r.stop(ctx, m)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// A reconcile may have replaced it meanwhile.
+	if r.running[id] == m {
+		statuses.update(id, func(st *containerStatus) { st.State = stateStopped })
+	}
+	return nil
+}
+
+// restartContainer stops a container and starts it again. It stays in
+// r.running while it stops so that a reconcile does not start a second
+// copy.
+func (r *reconciler) restartContainer(ctx context.Context, id string) error {
+	m, err := r.lookup(id)
+	if err != nil {
+		return err
+	}
+	logger.Printf("Restarting container %q on request", id)
+	r.stop(ctx, m)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// If a reconcile replaced it meanwhile the replacement is running.
+	if r.running[id] == m {
+		r.start(ctx, m.svc)
+	}
+	return nil
+}
+
+func (r *reconciler) run(ctx, setup context.Context, m *managedContainer) {
+	defer close(m.done)
+	defer m.cancel()
+
+	// Drop what an earlier caaos or version of the spec left behind.
+	if err := removeContainer(ctx, r.client, m.svc.ID); err != nil {
+		logger.Printf("Error removing old container %q: %v", m.svc.ID, err)
+	}
+	m.svc.supervise(ctx, setup, r.client)
+	if err := removeContainer(ctx, r.client, m.svc.ID); err != nil {
+		logger.Printf("Error removing container %q: %v", m.svc.ID, err)
+	}
+	if m.svc.StopOnExit && setup.Err() == nil {
+		logger.Printf("Container %q finished, shutting down", m.svc.ID)
+		powerOff()
+	}
+}
+
+// stop kills the task of m, with SIGTERM first and SIGKILL after
+// stopTimeout, and waits for its container to be removed.
+func (r *reconciler) stop(ctx context.Context, m *managedContainer) {
+	m.cancel()
+	deadline := time.Now().Add(stopTimeout)
+	signalled := false
+	for {
+		// The task may only show up later if the container was still
+		// being created.
+		if !signalled || time.Now().After(deadline) {
+			sig := syscall.SIGTERM
+			if signalled {
+				sig = syscall.SIGKILL
+			}
+			if c, err := r.client.LoadContainer(ctx, m.svc.ID); err == nil {
+				if task, err := c.Task(ctx, nil); err == nil {
+					task.Kill(ctx, sig)
+				}
+			}
+			signalled = true
+		}
+		select {
+		case <-m.done:
+			logger.Printf("Container %q stopped", m.svc.ID)
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// removeContainer deletes container id and its task if they exist.
+func removeContainer(ctx context.Context, client *containerd.Client, id string) error {
+	c, err := client.LoadContainer(ctx, id)
+	if errdefs.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if task, err := c.Task(ctx, nil); err == nil {
+		if _, err := task.Delete(ctx, containerd.WithProcessKill); err != nil {
+			return err
+		}
+	}
+	return c.Delete(ctx, containerd.WithSnapshotCleanup)
+}
+
+func powerOff() {
+	logs.Flush(5 * time.Second)
+	syscall.Sync()
+	if err := syscall.Reboot(syscall.LINUX_REBOOT_CMD_POWER_OFF); err != nil {
+		logger.Println("Error calling shutdown:", err)
+	}
+	select {}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+)
+
+const (
+	restartNever     = "never"
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+
+	minRestartBackoff = time.Second
+	maxRestartBackoff = 5 * time.Minute
+	// stableRun is how long a container has to run for its backoff and
+	// retry count to be reset.
+	stableRun = time.Minute
+)
+
+// restartPolicy says when a container is restarted after its task exits.
+type restartPolicy struct {
+	// Policy is never (the default), on-failure, restarting on a non zero
+	// exit code or an error running the task, or always.
+	Policy string
+	// MaxRetries limits the restarts in a row of on-failure, 0 means no
+	// limit. Running for stableRun resets the count.
+	MaxRetries int
+}
+
+func (p restartPolicy) validate() error {
+	switch p.Policy {
+	case "", restartNever, restartOnFailure, restartAlways:
+	default:
+		return fmt.Errorf("unknown restart policy %q", p.Policy)
+	}
+	if p.MaxRetries < 0 {
+		return fmt.Errorf("negative MaxRetries %d", p.MaxRetries)
+	}
+	return nil
+}
+
+// restart reports whether a task that exited with code and err is restarted
+// after retries restarts in a row.
+func (p restartPolicy) restart(code uint32, err error, retries int) bool {
+	switch p.Policy {
+	case restartAlways:
+		return true
+	case restartOnFailure:
+		failed := err != nil || code != 0
+		return failed && (p.MaxRetries == 0 || retries < p.MaxRetries)
+	}
+	return false
+}
+
+const (
+	stateCreating   = "creating"
+	stateRunning    = "running"
+	stateRestarting = "restarting"
+	stateExited     = "exited"
+	stateFailed     = "failed"
+	stateStopped    = "stopped"
+)
+
+// containerStatus is what caaos knows about one of its containers.
+type containerStatus struct {
+	ID        string
+	State     string
+	PID       uint32 `json:",omitempty"`
+	StartedAt time.Time
+	// Ready is set while the container is running and, if it has a
+	// readiness probe, passing it.
+	Ready bool
+	// Health is the result of the liveness probe, empty without one.
+	Health         string `json:",omitempty"`
+	LastProbeError string `json:",omitempty"`
+	// Restarts counts all restarts since caaos started the container.
+	Restarts     int
+	LastExitCode uint32
+	LastExit     time.Time
+	LastError    string `json:",omitempty"`
+}
+
+type statusTable struct {
+	mu sync.Mutex
+	m  map[string]*containerStatus
+	// ch is closed and replaced on every change.
+	ch chan struct{}
+}
+
+var statuses = &statusTable{m: map[string]*containerStatus{}, ch: make(chan struct{})}
+
+// changed returns a channel closed on the next change.
+func (t *statusTable) changed() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ch
+}
+
+func (t *statusTable) notify() {
+	close(t.ch)
+	t.ch = make(chan struct{})
+}
+
+// update changes the status of container id, adding it if needed.
+func (t *statusTable) update(id string, f func(*containerStatus)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.m[id]
+	if !ok {
+		st = &containerStatus{ID: id}
+		t.m[id] = st
+	}
+	f(st)
+	t.notify()
+}
+
+func (t *statusTable) get(id string) (containerStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.m[id]
+	if !ok {
+		return containerStatus{}, false
+	}
+	return *st, true
+}
+
+func (t *statusTable) list() []containerStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var l []containerStatus
+	for _, st := range t.m {
+		l = append(l, *st)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].ID < l[j].ID })
+	return l
+}
+
+func (t *statusTable) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.m, id)
+	t.notify()
+}
+
+// supervise runs the container of s once its dependencies are met, until it
+// exits and its RestartPolicy does not restart it, or stop is canceled.
+func (s *caaosService) supervise(ctx, stop context.Context, client *containerd.Client) {
+	statuses.update(s.ID, func(st *containerStatus) { *st = containerStatus{ID: s.ID, State: stateWaiting} })
+	if err := s.waitDependencies(stop); err != nil {
+		if stop.Err() != nil {
+			return
+		}
+		logger.Printf("Not starting container %q: %v", s.ID, err)
+		statuses.update(s.ID, func(st *containerStatus) {
+			st.State = stateFailed
+			st.LastError = err.Error()
+		})
+		return
+	}
+	statuses.update(s.ID, func(st *containerStatus) { st.State = stateCreating })
+
+	backoff := minRestartBackoff
+	retries := 0
+	var container containerd.Container
+	for {
+		var code uint32
+		var err error
+		started := time.Now()
+		if container == nil {
+			container, err = s.getContainer(stop, client)
+		}
+		if err == nil {
+			code, err = runContainer(ctx, container, s.HealthCheck)
+		}
+		statuses.update(s.ID, func(st *containerStatus) {
+			st.PID = 0
+			st.Ready = false
+			st.Health = ""
+			st.LastExitCode = code
+			st.LastExit = time.Now()
+			st.LastError = ""
+			if err != nil {
+				st.LastError = err.Error()
+			}
+		})
+		if err != nil {
+			logger.Printf("Error running container %q: %v", s.ID, err)
+		}
+		if stop.Err() != nil {
+			return
+		}
+
+		if time.Since(started) >= stableRun {
+			backoff = minRestartBackoff
+			retries = 0
+		}
+		if !s.RestartPolicy.restart(code, err, retries) {
+			state := stateExited
+			if err != nil || code != 0 {
+				state = stateFailed
+			}
+			if s.RestartPolicy.Policy == restartOnFailure && state == stateFailed {
+				logger.Printf("Container %q failed %d times in a row, not restarting it", s.ID, retries+1)
+			}
+			statuses.update(s.ID, func(st *containerStatus) { st.State = state })
+			return
+		}
+
+		retries++
+		statuses.update(s.ID, func(st *containerStatus) {
+			st.State = stateRestarting
+			st.Restarts++
+		})
+		logger.Printf("Restarting container %q in %s (restart %d in a row)", s.ID, backoff, retries)
+		if sleepContext(stop, backoff) != nil {
+			return
+		}
+		if backoff *= 2; backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Interactive calls switch the connection to a stream of frames: a type
+// byte, a big endian uint32 length and the data.
+const (
+	streamUpgrade = "caaos-stream"
+
+	frameStdin    = 0
+	frameStdout   = 1
+	frameStderr   = 2
+	frameStdinEOF = 3
+	// frameResize carries the terminal's columns and rows as two uint16.
+	frameResize = 4
+	// frameExit carries the exit code as a uint32 and ends the stream.
+	frameExit = 5
+	// frameError carries a message and ends the stream.
+	frameError = 6
+
+	maxFrame = 1 << 20
+	// stdinQueue is how many stdin frames wait for the process before the
+	// client is held up.
+	stdinQueue = 64
+)
+
+type streamConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex
+}
+
+// upgradeStream takes over the connection of an HTTP request that asked for
+// streamUpgrade.
+func upgradeStream(w http.ResponseWriter, r *http.Request) (*streamConn, error) {
+	if r.Header.Get("Upgrade") != streamUpgrade {
+		return nil, fmt.Errorf("want Upgrade: %s", streamUpgrade)
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("connection cannot be taken over")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nConnection: Upgrade\r\n\r\n", streamUpgrade)
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &streamConn{conn: conn, r: rw.Reader}, nil
+}
+
+func (s *streamConn) writeFrame(typ byte, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var hdr [5]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(data)))
+	if _, err := s.conn.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(data)
+	return err
+}
+
+func (s *streamConn) readFrame() (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxFrame {
+		return 0, nil, fmt.Errorf("frame of %d bytes too large", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(s.r, data); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], data, nil
+}
+
+func (s *streamConn) exit(code uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], code)
+	s.writeFrame(frameExit, b[:])
+}
+
+func (s *streamConn) fail(err error) {
+	s.writeFrame(frameError, []byte(err.Error()))
+}
+
+// frameWriter writes to the stream as frames of one type.
+type frameWriter struct {
+	s   *streamConn
+	typ byte
+}
+
+func (w *frameWriter) Write(b []byte) (int, error) {
+	if err := w.s.writeFrame(w.typ, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// pump feeds stdin frames to stdin and resize frames to resize until the
+// client is done, the connection closes or exited is closed. Input is never
+// dropped while the process reads stdin: once stdinQueue frames wait for it
+// pump stops reading, which holds up the client through the socket. Resizes
+// are made by their own goroutine, only the latest one if they pile up.
+func (s *streamConn) pump(stdin *io.PipeWriter, resize func(cols, rows uint32), exited <-chan struct{}) {
+	// Closing stdin also ends a write blocked on it.
+	defer stdin.Close()
+	queue := make(chan []byte, stdinQueue)
+	go func() {
+		defer stdin.Close()
+		for data := range queue {
+			if _, err := stdin.Write(data); err != nil {
+				// The process closed stdin, discard the rest as a
+				// closed pipe would.
+				for range queue {
+				}
+				return
+			}
+		}
+	}()
+	eof := false
+	defer func() {
+		if !eof {
+			close(queue)
+		}
+	}()
+
+	sizes := make(chan [2]uint32, 1)
+	defer close(sizes)
+	go func() {
+		for size := range sizes {
+			resize(size[0], size[1])
+		}
+	}()
+
+	for {
+		typ, data, err := s.readFrame()
+		if err != nil {
+			return
+		}
+		switch typ {
+		case frameStdin:
+			if eof {
+				continue
+			}
+			select {
+			case queue <- data:
+			case <-exited:
+				return
+			}
+		case frameStdinEOF:
+			if !eof {
+				eof = true
+				close(queue)
+			}
+		case frameResize:
+			if len(data) != 4 {
+				continue
+			}
+			size := [2]uint32{uint32(binary.BigEndian.Uint16(data)), uint32(binary.BigEndian.Uint16(data[2:]))}
+			// Replace a resize not made yet.
+			select {
+			case <-sizes:
+			default:
+			}
+			sizes <- size
+		}
+	}
+}
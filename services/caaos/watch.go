@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// watchHealthFile has the watchHealth of the running caaos as JSON.
+var watchHealthFile = "/run/caaos/metadata-watch.json"
+
+const (
+	minWatchBackoff = time.Second
+	maxWatchBackoff = 5 * time.Minute
+	// unhealthyAfter failures in a row mark the watch unhealthy.
+	unhealthyAfter = 3
+)
+
+// watchHealth is the state of the metadata watch.
+type watchHealth struct {
+	Healthy     bool
+	Version     string `json:",omitempty"`
+	LastSuccess time.Time
+	LastError   string `json:",omitempty"`
+	LastErrorAt time.Time
+	Failures    int
+	// LastTimeout is when a watch request last ran out of time without
+	// an answer, which is retried right away and is not a failure.
+	LastTimeout time.Time
+}
+
+// metadataWatcher keeps watching a provider and hands the latest attributes
+// to a reader. Updates not yet read are replaced by newer ones, so a busy
+// reader never holds up the watch.
+type metadataWatcher struct {
+	provider metadataProvider
+	updates  chan *attributesJSON
+
+	mu     sync.Mutex
+	health watchHealth
+}
+
+func newMetadataWatcher(provider metadataProvider) *metadataWatcher {
+	return &metadataWatcher{
+		provider: provider,
+		updates:  make(chan *attributesJSON, 1),
+		health:   watchHealth{Healthy: true},
+	}
+}
+
+// isTimeout reports whether err is a watch request running out of time
+// once connected. Timeouts dialing the provider are failures.
+func isTimeout(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// backoff returns the wait after the given number of failures in a row,
+// doubling from minWatchBackoff up to maxWatchBackoff with up to 50% jitter.
+func backoff(failures int) time.Duration {
+	d := minWatchBackoff
+	for i := 1; i < failures && d < maxWatchBackoff; i++ {
+		d *= 2
+	}
+	if d > maxWatchBackoff {
+		d = maxWatchBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (w *metadataWatcher) status() watchHealth {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.health
+}
+
+// writeHealth saves the health to watchHealthFile, with w.mu held.
+func (w *metadataWatcher) writeHealth() {
+	b, _ := json.MarshalIndent(w.health, "", "  ")
+	tmp := watchHealthFile + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(tmp), 0755); err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(tmp, b, 0644); err == nil {
+		os.Rename(tmp, watchHealthFile)
+	}
+}
+
+func (w *metadataWatcher) succeeded(version string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer w.writeHealth()
+	if !w.health.Healthy {
+		logger.Printf("Metadata watch recovered after %d failures", w.health.Failures)
+	}
+	w.health.Healthy = true
+	w.health.Failures = 0
+	w.health.Version = version
+	w.health.LastSuccess = time.Now()
+}
+
+func (w *metadataWatcher) timedOut() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer w.writeHealth()
+	w.health.LastTimeout = time.Now()
+}
+
+func (w *metadataWatcher) failed(err error) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer w.writeHealth()
+	w.health.Failures++
+	w.health.LastError = err.Error()
+	w.health.LastErrorAt = time.Now()
+	if w.health.Healthy && w.health.Failures >= unhealthyAfter {
+		last := "never"
+		if !w.health.LastSuccess.IsZero() {
+			last = w.health.LastSuccess.Format(time.RFC3339)
+		}
+		logger.Printf("Metadata watch unhealthy, last success %s", last)
+		w.health.Healthy = false
+	}
+	return w.health.Failures
+}
+
+func (w *metadataWatcher) send(md *attributesJSON) {
+	for {
+		select {
+		case w.updates <- md:
+			return
+		default:
+		}
+		// Drop the update the reader has not picked up yet.
+		select {
+		case <-w.updates:
+		default:
+		}
+	}
+}
+
+// run watches until ctx is canceled.
+func (w *metadataWatcher) run(ctx context.Context) {
+	var version string
+	for ctx.Err() == nil {
+		data, v, err := w.provider.watch(ctx, version)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && isTimeout(err) {
+			// The provider took too long to answer a hanging request,
+			// ask again.
+			logger.Println("Metadata watch timed out, retrying:", err)
+			w.timedOut()
+			continue
+		}
+		if err != nil {
+			failures := w.failed(err)
+			d := backoff(failures)
+			logger.Printf("Error watching metadata (%d in a row), retrying in %s: %v", failures, d.Round(time.Millisecond), err)
+			sleepContext(ctx, d)
+			continue
+		}
+
+		w.succeeded(v)
+		version = v
+		var md attributesJSON
+		if err := json.Unmarshal(data, &md); err != nil {
+			// Wait for the next version rather than fetching this one again.
+			logger.Println("Error parsing metadata:", err)
+			continue
+		}
+		w.send(&md)
+	}
+}
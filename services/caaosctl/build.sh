@@ -0,0 +1,11 @@
+set -ex
+
+go mod download
+
+cd services/caaosctl
+mkdir -p pkgroot/p3/bin
+
+CGO_ENABLED=0 go build -tags 'netgo,osusergo,static_build' -ldflags '-s -w -extldflags=-static' -o pkgroot/p3/bin/caaosctl
+
+mkdir -p /workspace/packages
+tar -czvf /workspace/packages/caaosctl.tar.gz -C pkgroot .
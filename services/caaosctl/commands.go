@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// container mirrors what the API returns for a container.
+type container struct {
+	ID             string
+	State          string
+	PID            uint32 `json:",omitempty"`
+	StartedAt      time.Time
+	Ready          bool
+	Health         string `json:",omitempty"`
+	LastProbeError string `json:",omitempty"`
+	Restarts       int
+	LastExitCode   uint32
+	LastExit       time.Time
+	LastError      string `json:",omitempty"`
+	Source         string
+	Image          string `json:",omitempty"`
+}
+
+type image struct {
+	Name   string
+	Digest string
+	Size   int64 `json:",omitempty"`
+}
+
+func oneArg(args []string, what string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("want one %s", what)
+	}
+	return args[0], nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func since(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return time.Since(t).Round(time.Second).String() + " ago"
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func ps(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("no arguments expected")
+	}
+	var l []container
+	if err := callJSON("GET", "/v1/containers", nil, &l); err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(l)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATE\tREADY\tHEALTH\tRESTARTS\tLAST EXIT\tSTARTED\tSOURCE\tIMAGE")
+	for _, c := range l {
+		exit := "-"
+		if !c.LastExit.IsZero() {
+			exit = strconv.FormatUint(uint64(c.LastExitCode), 10)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%s\t%d\t%s\t%s\t%s\t%s\n", c.ID, c.State, c.Ready, orDash(c.Health), c.Restarts, exit, since(c.StartedAt), c.Source, orDash(c.Image))
+	}
+	return tw.Flush()
+}
+
+func logs(args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	follow := fs.Bool("f", false, "follow new lines")
+	tail := fs.Int("tail", -1, "number of lines to show, all by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	id, err := oneArg(fs.Args(), "container ID")
+	if err != nil {
+		return err
+	}
+	q := url.Values{}
+	q.Set("tail", strconv.Itoa(*tail))
+	q.Set("follow", strconv.FormatBool(*follow))
+	resp, err := call("GET", "/v1/containers/"+url.PathEscape(id)+"/logs?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+// inspect prints the state and the effective OCI spec of a container, always
+// as JSON.
+func inspect(args []string) error {
+	id, err := oneArg(args, "container ID")
+	if err != nil {
+		return err
+	}
+	var out struct {
+		Container container
+		Spec      json.RawMessage `json:",omitempty"`
+	}
+	if err := callJSON("GET", "/v1/containers/"+url.PathEscape(id), nil, &out.Container); err != nil {
+		return err
+	}
+	// A container still waiting or being pulled has no spec yet.
+	if err := callJSON("GET", "/v1/containers/"+url.PathEscape(id)+"/spec", nil, &out.Spec); err != nil {
+		fmt.Fprintf(os.Stderr, "caaosctl inspect: no spec: %v\n", err)
+	}
+	return printJSON(out)
+}
+
+func containerAction(action string) func([]string) error {
+	return func(args []string) error {
+		id, err := oneArg(args, "container ID")
+		if err != nil {
+			return err
+		}
+		var c container
+		if err := callJSON("POST", "/v1/containers/"+url.PathEscape(id)+"/"+action, nil, &c); err != nil {
+			return err
+		}
+		if *jsonOut {
+			return printJSON(c)
+		}
+		fmt.Printf("%s: %s\n", c.ID, c.State)
+		return nil
+	}
+}
+
+func pull(args []string) error {
+	ref, err := oneArg(args, "image reference")
+	if err != nil {
+		return err
+	}
+	var img image
+	if err := callJSON("POST", "/v1/images/pull?ref="+url.QueryEscape(ref), nil, &img); err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(img)
+	}
+	fmt.Printf("%s %s\n", img.Name, img.Digest)
+	return nil
+}
+
+func listImages(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("no arguments expected")
+	}
+	var l []image
+	if err := callJSON("GET", "/v1/images", nil, &l); err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(l)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tDIGEST\tSIZE")
+	for _, img := range l {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", img.Name, img.Digest, humanSize(img.Size))
+	}
+	return tw.Flush()
+}
+
+func rmi(args []string) error {
+	ref, err := oneArg(args, "image reference")
+	if err != nil {
+		return err
+	}
+	if err := callJSON("DELETE", "/v1/images?ref="+url.QueryEscape(ref), nil, &struct{}{}); err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(struct{ Removed string }{ref})
+	}
+	fmt.Println("Removed", ref)
+	return nil
+}
+
+// validate has caaos check a service file or a containers list, so the
+// rules are the ones of the running version.
+func validate(args []string) error {
+	file, err := oneArg(args, "file")
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := callJSON("POST", "/v1/validate", bytes.NewReader(data), &struct{}{}); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	if *jsonOut {
+		return printJSON(struct{ Valid string }{file})
+	}
+	fmt.Printf("%s: ok\n", file)
+	return nil
+}
+
+func metadata(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("no arguments expected")
+	}
+	var health json.RawMessage
+	if err := callJSON("GET", "/v1/metadata", nil, &health); err != nil {
+		return err
+	}
+	return printJSON(health)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// execRequest and debugRequest mirror the bodies caaos expects.
+type execRequest struct {
+	Args       []string
+	Env        []string `json:",omitempty"`
+	Cwd        string   `json:",omitempty"`
+	TTY        bool
+	Cols, Rows uint32
+}
+
+type debugRequest struct {
+	execRequest
+	Image      string `json:",omitempty"`
+	Privileged bool
+}
+
+// envFlag collects repeated -e KEY=VALUE flags.
+type envFlag []string
+
+func (e *envFlag) String() string { return strings.Join(*e, ",") }
+
+func (e *envFlag) Set(v string) error {
+	if !strings.Contains(v, "=") {
+		return fmt.Errorf("want KEY=VALUE, got %q", v)
+	}
+	*e = append(*e, v)
+	return nil
+}
+
+func execFlags(name string, req *execRequest) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.BoolVar(&req.TTY, "t", false, "allocate a terminal")
+	fs.Var((*envFlag)(&req.Env), "e", "set an environment variable, KEY=VALUE")
+	fs.StringVar(&req.Cwd, "w", "", "working directory")
+	return fs
+}
+
+func setTerminalSize(req *execRequest) {
+	if !req.TTY {
+		return
+	}
+	if cols, rows, ok := terminalSize(int(os.Stdout.Fd())); ok {
+		req.Cols, req.Rows = uint32(cols), uint32(rows)
+	}
+}
+
+// execCmd runs a command in a running container.
+func execCmd(args []string) error {
+	var req execRequest
+	fs := execFlags("exec", &req)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return fmt.Errorf("want a container ID and a command")
+	}
+	req.Args = fs.Args()[1:]
+	setTerminalSize(&req)
+	s, err := openStream("/v1/containers/"+url.PathEscape(fs.Arg(0))+"/exec", req)
+	if err != nil {
+		return err
+	}
+	return s.interact(req.TTY)
+}
+
+// debug runs an ephemeral toolbox container in the PID and network
+// namespaces of a running container.
+func debug(args []string) error {
+	var req debugRequest
+	fs := execFlags("debug", &req.execRequest)
+	fs.StringVar(&req.Image, "image", "", "toolbox image, caaos' default if empty")
+	fs.BoolVar(&req.Privileged, "privileged", false, "give the debug container all capabilities")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return fmt.Errorf("want a container ID")
+	}
+	req.Args = fs.Args()[1:]
+	setTerminalSize(&req.execRequest)
+	s, err := openStream("/v1/containers/"+url.PathEscape(fs.Arg(0))+"/debug", req)
+	if err != nil {
+		return err
+	}
+	return s.interact(req.TTY)
+}
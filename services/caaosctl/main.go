@@ -0,0 +1,145 @@
+// caaosctl talks to the control API of caaos on its unix socket.
+//
+// The host has no shell. caaosctl runs in a debug container, where caaos
+// mounts the binary at /usr/local/bin/caaosctl and the socket under
+// /run/caaos, or in any container given the host's /bin/caaosctl and
+// /run/caaos:
+//
+//	caaosctl debug -t <id> sh
+//	/ # caaosctl ps
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+var (
+	socket   = flag.String("socket", "/run/caaos/caaos.sock", "caaos control socket")
+	jsonOut  = flag.Bool("json", false, "print JSON instead of tables")
+	commands map[string]command
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+func init() {
+	commands = map[string]command{
+		"ps":       {"ps", ps},
+		"logs":     {"logs [-f] [-tail n] <id>", logs},
+		"inspect":  {"inspect <id>", inspect},
+		"start":    {"start <id>", containerAction("start")},
+		"stop":     {"stop <id>", containerAction("stop")},
+		"restart":  {"restart <id>", containerAction("restart")},
+		"pull":     {"pull <ref>", pull},
+		"images":   {"images", listImages},
+		"rmi":      {"rmi <ref>", rmi},
+		"validate": {"validate <file>", validate},
+		"metadata": {"metadata", metadata},
+		"exec":     {"exec [-t] [-e KEY=VALUE] [-w dir] <id> <command> [args]", execCmd},
+		"debug":    {"debug [-t] [-image ref] [-privileged] <id> [command] [args]", debug},
+	}
+}
+
+var client = &http.Client{
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", *socket)
+		},
+	},
+}
+
+// apiError is the body caaos answers failed requests with.
+type apiError struct {
+	Error string
+}
+
+// call sends a request to caaos and returns the response of a successful
+// one, the caller closes its body.
+func call(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://caaos"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	var e apiError
+	if json.Unmarshal(b, &e) == nil && e.Error != "" {
+		return nil, fmt.Errorf("%s", e.Error)
+	}
+	return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+}
+
+// callJSON sends a request and decodes the JSON response into v.
+func callJSON(method, path string, body io.Reader, v interface{}) error {
+	resp, err := call(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: caaosctl [-json] [-socket path] <command> [args]\n\ncommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "caaosctl: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	err := cmd.run(flag.Args()[1:])
+	var code exitCode
+	if errors.As(err, &code) {
+		os.Exit(int(code))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "caaosctl %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The frames of an interactive call, see stream.go in caaos.
+const (
+	streamUpgrade = "caaos-stream"
+
+	frameStdin    = 0
+	frameStdout   = 1
+	frameStderr   = 2
+	frameStdinEOF = 3
+	frameResize   = 4
+	frameExit     = 5
+	frameError    = 6
+
+	maxFrame = 1 << 20
+)
+
+// exitCode makes caaosctl exit with the code of a remote process.
+type exitCode int
+
+func (c exitCode) Error() string {
+	return fmt.Sprintf("exit code %d", int(c))
+}
+
+type streamConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex
+}
+
+// openStream posts req as JSON to path and switches the connection to
+// frames.
+func openStream(path string, req interface{}) (*streamConn, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("unix", *socket)
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := http.NewRequest("POST", "http://caaos"+path, bytes.NewReader(body))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set("Connection", "Upgrade")
+	hreq.Header.Set("Upgrade", streamUpgrade)
+	if err := hreq.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, hreq)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		var e apiError
+		if json.Unmarshal(b, &e) == nil && e.Error != "" {
+			return nil, fmt.Errorf("%s", e.Error)
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return &streamConn{conn: conn, r: r}, nil
+}
+
+func (s *streamConn) writeFrame(typ byte, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var hdr [5]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(data)))
+	if _, err := s.conn.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(data)
+	return err
+}
+
+func (s *streamConn) readFrame() (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxFrame {
+		return 0, nil, fmt.Errorf("frame of %d bytes too large", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(s.r, data); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], data, nil
+}
+
+func (s *streamConn) resize(cols, rows uint16) {
+	var b [4]byte
+	binary.BigEndian.PutUint16(b[:], cols)
+	binary.BigEndian.PutUint16(b[2:], rows)
+	s.writeFrame(frameResize, b[:])
+}
+
+// terminalSize returns the size of the terminal on fd.
+func terminalSize(fd int) (cols, rows uint16, ok bool) {
+	ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+	if err != nil {
+		return 0, 0, false
+	}
+	return ws.Col, ws.Row, true
+}
+
+func isTerminal(fd int) bool {
+	_, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	return err == nil
+}
+
+// makeRaw puts the terminal on fd in raw mode and returns a function
+// restoring it.
+func makeRaw(fd int) (func(), error) {
+	old, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+	raw := *old
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+	return func() { unix.IoctlSetTermios(fd, unix.TCSETS, old) }, nil
+}
+
+// interact connects the local stdio to the stream until the remote process
+// exits and returns its exit code as an exitCode error.
+func (s *streamConn) interact(tty bool) error {
+	defer s.conn.Close()
+	stdin := int(os.Stdin.Fd())
+	if tty && isTerminal(stdin) {
+		restore, err := makeRaw(stdin)
+		if err != nil {
+			return err
+		}
+		defer restore()
+
+		winch := make(chan os.Signal, 1)
+		signal.Notify(winch, syscall.SIGWINCH)
+		defer signal.Stop(winch)
+		go func() {
+			for range winch {
+				if cols, rows, ok := terminalSize(stdin); ok {
+					s.resize(cols, rows)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				if s.writeFrame(frameStdin, buf[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				s.writeFrame(frameStdinEOF, nil)
+				return
+			}
+		}
+	}()
+
+	for {
+		typ, data, err := s.readFrame()
+		if err != nil {
+			return fmt.Errorf("connection lost: %v", err)
+		}
+		switch typ {
+		case frameStdout:
+			os.Stdout.Write(data)
+		case frameStderr:
+			os.Stderr.Write(data)
+		case frameExit:
+			if len(data) != 4 {
+				return fmt.Errorf("bad exit frame")
+			}
+			if code := binary.BigEndian.Uint32(data); code != 0 {
+				return exitCode(code)
+			}
+			return nil
+		case frameError:
+			return fmt.Errorf("%s", data)
+		}
+	}
+}
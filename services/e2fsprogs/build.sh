@@ -0,0 +1,19 @@
+set -ex
+
+apk add --no-cache build-base linux-headers
+
+cd services/e2fsprogs
+mkdir -p pkgroot/p3/bin
+
+# Only mke2fs is shipped, init runs it to format data disks.
+git -c advice.detachedHead=false clone -b v1.46.5 https://git.kernel.org/pub/scm/fs/ext2/e2fsprogs.git
+cd e2fsprogs
+./configure --disable-nls --disable-fuse2fs --disable-e2initrd-helper LDFLAGS=-static
+make -j $(nproc) libs
+make -C misc mke2fs
+strip misc/mke2fs
+cp misc/mke2fs ../pkgroot/p3/bin/
+cd ..
+
+mkdir -p /workspace/packages
+tar -czvf /workspace/packages/e2fsprogs.tar.gz -C pkgroot .